@@ -0,0 +1,242 @@
+package calculator
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Error is an evaluation error with its code in the JSON protocol
+type Error struct {
+	code string
+	msg  string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func (e *Error) Code() string {
+	return e.code
+}
+
+// Errorf returns an Error with the given code and formatted message
+func Errorf(code, format string, args ...any) error {
+	return &Error{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+var errDivisionByZero = &Error{code: CodeDivisionByZero, msg: "Division by zero"}
+
+// exprParser is a recursive descent parser evaluating infix arithmetic:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = "-" unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | name | name "(" expr { "," expr } ")" | "(" expr ")"
+//
+// The operators and functions are evaluated by the registered operations of
+// the same name, the prefix "-" by neg.
+type exprParser struct {
+	tokens []string
+	pos    int
+	mode   Mode
+	vars   map[string]Number
+}
+
+// Evaluate computes an infix expression such as (3 + 4) * sqrt(a) in the
+// given numeric mode, looking up names that are not function calls in vars
+func Evaluate(expr string, mode Mode, vars map[string]Number) (Number, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return Number{}, err
+	}
+	if len(tokens) == 0 {
+		return Number{}, Errorf(CodeSyntaxError, "empty expression")
+	}
+	p := &exprParser{tokens: tokens, mode: mode, vars: vars}
+	v, err := p.expr()
+	if err != nil {
+		return Number{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return Number{}, Errorf(CodeSyntaxError, "unexpected %q", p.tokens[p.pos])
+	}
+	return v, nil
+}
+
+// tokenize splits expr into numbers, names and single character operators
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			// Exponent, as in 1e-3
+			if j < len(runes) && (runes[j] == 'e' || runes[j] == 'E') {
+				k := j + 1
+				if k < len(runes) && (runes[k] == '+' || runes[k] == '-') {
+					k++
+				}
+				if k < len(runes) && unicode.IsDigit(runes[k]) {
+					for j = k; j < len(runes) && unicode.IsDigit(runes[j]); j++ {
+					}
+				}
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case strings.ContainsRune("+-*/%^(),", r):
+			tokens = append(tokens, string(r))
+			i++
+		default:
+			return nil, Errorf(CodeSyntaxError, "unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if got := p.next(); got != t {
+		if got == "" {
+			return Errorf(CodeSyntaxError, "expected %q at end of expression", t)
+		}
+		return Errorf(CodeSyntaxError, "expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *exprParser) expr() (Number, error) {
+	v, err := p.term()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()
+		var w Number
+		if w, err = p.term(); err == nil {
+			v, err = p.apply(op, v, w)
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) term() (Number, error) {
+	v, err := p.unary()
+	for err == nil && (p.peek() == "*" || p.peek() == "/" || p.peek() == "%") {
+		op := p.next()
+		var w Number
+		if w, err = p.unary(); err == nil {
+			v, err = p.apply(op, v, w)
+		}
+	}
+	return v, err
+}
+
+// unary binds looser than ^, so -2^2 is -4
+func (p *exprParser) unary() (Number, error) {
+	if p.peek() == "-" {
+		p.next()
+		v, err := p.unary()
+		if err != nil {
+			return Number{}, err
+		}
+		return p.apply("neg", v)
+	}
+	return p.power()
+}
+
+// power is right associative: 2^3^2 is 2^9
+func (p *exprParser) power() (Number, error) {
+	v, err := p.atom()
+	if err != nil || p.peek() != "^" {
+		return v, err
+	}
+	p.next()
+	w, err := p.unary()
+	if err != nil {
+		return Number{}, err
+	}
+	return p.apply("^", v, w)
+}
+
+func (p *exprParser) atom() (Number, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return Number{}, Errorf(CodeSyntaxError, "unexpected end of expression")
+	case t == "(":
+		v, err := p.expr()
+		if err != nil {
+			return Number{}, err
+		}
+		return v, p.expect(")")
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		return p.mode.Parse(t)
+	case (unicode.IsLetter(rune(t[0])) || t[0] == '_') && p.peek() == "(":
+		return p.call(t)
+	case unicode.IsLetter(rune(t[0])) || t[0] == '_':
+		v, ok := p.vars[t]
+		if !ok {
+			return Number{}, Errorf(CodeUnknownName, "unknown variable %q", t)
+		}
+		return p.mode.Convert(v)
+	}
+	return Number{}, Errorf(CodeSyntaxError, "unexpected %q", t)
+}
+
+// apply evaluates the operator called symbol
+func (p *exprParser) apply(symbol string, args ...Number) (Number, error) {
+	return operationsByName[symbol].Eval(p.mode, args)
+}
+
+// call evaluates the arguments of function name and applies it
+func (p *exprParser) call(name string) (Number, error) {
+	op := LookupOperation(name)
+	if op == nil || op.Syntax != Function {
+		return Number{}, Errorf(CodeUnknownName, "unknown function %q", name)
+	}
+	p.next() // "("
+	var args []Number
+	for {
+		v, err := p.expr()
+		if err != nil {
+			return Number{}, err
+		}
+		args = append(args, v)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return Number{}, err
+	}
+	if len(args) != op.Arity {
+		return Number{}, Errorf(CodeSyntaxError, "%s takes %d arguments, got %d", name, op.Arity, len(args))
+	}
+	return op.Eval(p.mode, args)
+}
@@ -0,0 +1,75 @@
+package calculator
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	vars := map[string]Number{"a": mustParse(t, DefaultMode, "3"), "half": mustParse(t, mustParseMode(t, "rat"), "1/2")}
+	tests := []struct {
+		expr, mode string
+		want       string // formatted result, or the error code after "!"
+	}{
+		{"2 + 3 * 4", "float", "14.000000"},
+		{"(2 + 3) * 4", "float", "20.000000"},
+		{"10 - 4 - 3", "float", "3.000000"},
+		{"12 / 3 / 2", "float", "2.000000"},
+		{"7 % 3", "float", "1.000000"},
+		{"-2 ^ 2", "float", "-4.000000"},
+		{"2 ^ 3 ^ 2", "float", "512.000000"},
+		{"2 ^ -1", "float", "0.500000"},
+		{"--1", "float", "1.000000"},
+		{"1e3 + 1.5E-1", "float", "1000.150000"},
+		{".5 * 4", "float", "2.000000"},
+		{"sqrt(16) + pow(2, 10)", "float", "1028.000000"},
+		{"mod(-7, 3)", "float", "-1.000000"},
+		{"min(3, -2) + max(3, -2)", "float", "1.000000"},
+		{"a * (a + 1)", "float", "12.000000"},
+		{"half + a", "rat", "7/2"},
+		{"half", "float", "0.500000"},
+		{"sqrt(a * a)", "int", "3"},
+
+		{"", "float", "!" + CodeSyntaxError},
+		{"1 +", "float", "!" + CodeSyntaxError},
+		{"(1 + 2", "float", "!" + CodeSyntaxError},
+		{"1 + 2)", "float", "!" + CodeSyntaxError},
+		{"2 $ 3", "float", "!" + CodeSyntaxError},
+		{"sqrt(1, 2)", "float", "!" + CodeSyntaxError},
+		{"max(1 2)", "float", "!" + CodeSyntaxError},
+		{"b + 1", "float", "!" + CodeUnknownName},
+		{"foo(1)", "float", "!" + CodeUnknownName},
+		{"add(1, 2)", "float", "!" + CodeUnknownName},
+		{"neg(1)", "float", "!" + CodeUnknownName},
+		{"1 / 0", "float", "!" + CodeDivisionByZero},
+		{"mod(1, 0)", "rat", "!" + CodeDivisionByZero},
+		{"sqrt(-1)", "float", "!" + CodeDomainError},
+		{"1.2.3", "float", "!" + CodeInvalidNumber},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := Evaluate(tt.expr, mode, vars)
+		checkResult(t, fmt.Sprintf("Evaluate(%q)", tt.expr), mode, got, err, tt.want)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"(3+4)*sqrt(a_1)", []string{"(", "3", "+", "4", ")", "*", "sqrt", "(", "a_1", ")"}},
+		{"1e-3 - 2E+2", []string{"1e-3", "-", "2E+2"}},
+		{"2e", []string{"2", "e"}},
+		{"  x ^ 2  ", []string{"x", "^", "2"}},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.expr)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("tokenize(%q) = %q, %v, want %q", tt.expr, got, err, tt.want)
+		}
+	}
+	if _, err := tokenize("1 # 2"); errorCode(err) != CodeSyntaxError {
+		t.Errorf("tokenize(1 # 2) = %v, want error %s", err, CodeSyntaxError)
+	}
+}
@@ -0,0 +1,372 @@
+package calculator
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultScale = 20    // digits after the decimal point in decimal mode
+	maxScale     = 1000  // largest precision a client may ask for
+	maxExponent  = 10000 // largest exponent accepted in number literals
+	maxPowBits   = 1 << 20
+)
+
+// Number is a value in one of the numeric modes
+type Number struct {
+	f float64  // value in float mode
+	r *big.Rat // value in the exact modes, nil in float mode
+}
+
+// Exact reports whether n is a value of the exact modes
+func (n Number) Exact() bool {
+	return n.r != nil
+}
+
+// Float64 returns n as a float64, the nearest one for exact values
+func (n Number) Float64() float64 {
+	if n.r != nil {
+		f, _ := n.r.Float64()
+		return f
+	}
+	return n.f
+}
+
+// MarshalText writes n as "f:<float>" or "r:<fraction>", keeping its exact
+// value
+func (n Number) MarshalText() ([]byte, error) {
+	if n.r != nil {
+		return []byte("r:" + n.r.RatString()), nil
+	}
+	return []byte("f:" + strconv.FormatFloat(n.f, 'g', -1, 64)), nil
+}
+
+// UnmarshalText reads a number written by MarshalText
+func (n *Number) UnmarshalText(text []byte) error {
+	kind, value, _ := strings.Cut(string(text), ":")
+	switch kind {
+	case "f":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*n = Number{f: f}
+		return nil
+	case "r":
+		if r, ok := new(big.Rat).SetString(value); ok {
+			*n = Number{r: r}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid number %q", text)
+}
+
+// Mode is a numeric mode of the calculator, deciding how numbers are parsed,
+// computed with and printed. The registered operations are built from its
+// arithmetic.
+//
+//	float        float64, printed with six decimals (the default)
+//	int          exact big integers, inexact results are errors
+//	rat          exact big rationals, printed as fractions
+//	decimal[:n]  decimals rounded half to even to n digits after the point
+type Mode interface {
+	Name() string
+	Parse(s string) (Number, error)
+	Convert(n Number) (Number, error) // into this mode, e.g. a variable set in another one
+	Format(n Number) string
+
+	Neg(x Number) (Number, error)
+	Add(x, y Number) (Number, error)
+	Sub(x, y Number) (Number, error)
+	Mul(x, y Number) (Number, error)
+	Quo(x, y Number) (Number, error)
+	Rem(x, y Number) (Number, error) // of truncated division, with the sign of x like math.Mod
+	Pow(x, y Number) (Number, error)
+	Sqrt(x Number) (Number, error)
+	Cmp(x, y Number) int // -1, 0 or +1 as x is less than, equal to or greater than y
+}
+
+// DefaultMode is float mode, the mode of new sessions
+var DefaultMode Mode = floatMode{}
+
+// ParseMode returns the mode named by spec, e.g. "int" or "decimal:4"
+func ParseMode(spec string) (Mode, error) {
+	name, digits, hasDigits := strings.Cut(spec, ":")
+	if hasDigits && name != "decimal" {
+		return nil, Errorf(CodeInvalidMode, "only decimal mode takes a precision")
+	}
+	switch name {
+	case "float":
+		return floatMode{}, nil
+	case "int", "rat":
+		return exactMode{kind: name}, nil
+	case "decimal":
+		scale := defaultScale
+		if hasDigits {
+			n, err := strconv.Atoi(digits)
+			if err != nil || n < 0 || n > maxScale {
+				return nil, Errorf(CodeInvalidMode, "precision must be between 0 and %d", maxScale)
+			}
+			scale = n
+		}
+		return exactMode{kind: name, scale: scale}, nil
+	}
+	return nil, Errorf(CodeInvalidMode, "unknown mode %q, use float, int, rat or decimal[:digits]", spec)
+}
+
+// floatMode computes with float64
+type floatMode struct{}
+
+func (floatMode) Name() string {
+	return "float"
+}
+
+func (floatMode) Parse(s string) (Number, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Number{}, Errorf(CodeInvalidNumber, "invalid number %q", s)
+	}
+	return Number{f: f}, nil
+}
+
+func (floatMode) Convert(n Number) (Number, error) {
+	if n.r != nil {
+		f, _ := n.r.Float64()
+		return Number{f: f}, nil
+	}
+	return n, nil
+}
+
+func (floatMode) Neg(x Number) (Number, error) {
+	return Number{f: -x.f}, nil
+}
+
+func (floatMode) Add(x, y Number) (Number, error) {
+	return Number{f: x.f + y.f}, nil
+}
+
+func (floatMode) Sub(x, y Number) (Number, error) {
+	return Number{f: x.f - y.f}, nil
+}
+
+func (floatMode) Mul(x, y Number) (Number, error) {
+	return Number{f: x.f * y.f}, nil
+}
+
+func (floatMode) Quo(x, y Number) (Number, error) {
+	if y.f == 0 {
+		return Number{}, errDivisionByZero
+	}
+	return Number{f: x.f / y.f}, nil
+}
+
+func (floatMode) Rem(x, y Number) (Number, error) {
+	if y.f == 0 {
+		return Number{}, errDivisionByZero
+	}
+	return Number{f: math.Mod(x.f, y.f)}, nil
+}
+
+func (floatMode) Pow(x, y Number) (Number, error) {
+	return Number{f: math.Pow(x.f, y.f)}, nil
+}
+
+func (floatMode) Sqrt(x Number) (Number, error) {
+	if x.f < 0 {
+		return Number{}, Errorf(CodeDomainError, "sqrt of negative number %g", x.f)
+	}
+	return Number{f: math.Sqrt(x.f)}, nil
+}
+
+func (floatMode) Cmp(x, y Number) int {
+	return cmp.Compare(x.f, y.f)
+}
+
+func (floatMode) Format(n Number) string {
+	return strconv.FormatFloat(n.f, 'f', 6, 64)
+}
+
+// exactMode computes with big.Rat; int and decimal mode restrict every result
+// to integers or to scale digits after the decimal point
+type exactMode struct {
+	kind  string // int, rat or decimal
+	scale int
+}
+
+func (m exactMode) Name() string {
+	if m.kind == "decimal" {
+		return "decimal:" + strconv.Itoa(m.scale)
+	}
+	return m.kind
+}
+
+func (m exactMode) Parse(s string) (Number, error) {
+	// An exponent such as 1e999999999 would allocate the whole number, and so
+	// would the binary exponents of hexadecimal literals such as 0x1p9999999:
+	// numbers are decimal, without base prefixes
+	if strings.ContainsAny(s, "xXbBoOpP") {
+		return Number{}, Errorf(CodeInvalidNumber, "invalid number %q", s)
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		if exp, err := strconv.Atoi(s[i+1:]); err != nil || exp > maxExponent || exp < -maxExponent {
+			return Number{}, Errorf(CodeInvalidNumber, "invalid number %q", s)
+		}
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Number{}, Errorf(CodeInvalidNumber, "invalid number %q", s)
+	}
+	if m.kind == "int" && !r.IsInt() {
+		return Number{}, Errorf(CodeInvalidNumber, "%s is not an integer", s)
+	}
+	return m.finish(r, s)
+}
+
+func (m exactMode) Convert(n Number) (Number, error) {
+	if n.r != nil {
+		return m.finish(n.r, n.r.RatString())
+	}
+	if math.IsInf(n.f, 0) || math.IsNaN(n.f) {
+		return Number{}, Errorf(CodeDomainError, "%g has no exact value", n.f)
+	}
+	return m.finish(new(big.Rat).SetFloat64(n.f), strconv.FormatFloat(n.f, 'g', -1, 64))
+}
+
+// finish brings a result into the mode, what names it in errors
+func (m exactMode) finish(r *big.Rat, what string) (Number, error) {
+	switch m.kind {
+	case "int":
+		if !r.IsInt() {
+			return Number{}, Errorf(CodeInexact, "%s is not an integer, use rat or decimal mode", what)
+		}
+	case "decimal":
+		r = roundRat(r, m.scale)
+	}
+	return Number{r: r}, nil
+}
+
+func (m exactMode) Neg(x Number) (Number, error) {
+	r := new(big.Rat).Neg(x.r)
+	return m.finish(r, r.RatString())
+}
+
+func (m exactMode) Add(x, y Number) (Number, error) {
+	r := new(big.Rat).Add(x.r, y.r)
+	return m.finish(r, r.RatString())
+}
+
+func (m exactMode) Sub(x, y Number) (Number, error) {
+	r := new(big.Rat).Sub(x.r, y.r)
+	return m.finish(r, r.RatString())
+}
+
+func (m exactMode) Mul(x, y Number) (Number, error) {
+	r := new(big.Rat).Mul(x.r, y.r)
+	return m.finish(r, r.RatString())
+}
+
+func (m exactMode) Quo(x, y Number) (Number, error) {
+	if y.r.Sign() == 0 {
+		return Number{}, errDivisionByZero
+	}
+	r := new(big.Rat).Quo(x.r, y.r)
+	return m.finish(r, x.r.RatString()+" / "+y.r.RatString())
+}
+
+func (m exactMode) Rem(x, y Number) (Number, error) {
+	if y.r.Sign() == 0 {
+		return Number{}, errDivisionByZero
+	}
+	// Truncated division like math.Mod: the result has the sign of x
+	q := new(big.Rat).Quo(x.r, y.r)
+	t := new(big.Int).Quo(q.Num(), q.Denom())
+	r := new(big.Rat).Sub(x.r, new(big.Rat).Mul(y.r, new(big.Rat).SetInt(t)))
+	return m.finish(r, r.RatString())
+}
+
+func (m exactMode) Cmp(x, y Number) int {
+	return x.r.Cmp(y.r)
+}
+
+// Pow only takes integer exponents, other powers are irrational in general
+func (m exactMode) Pow(base, exponent Number) (Number, error) {
+	x, y := base.r, exponent.r
+	if !y.IsInt() {
+		return Number{}, Errorf(CodeInexact, "exponent %s is not an integer, use float mode", y.RatString())
+	}
+	exp := new(big.Int).Abs(y.Num())
+	bits := max(x.Num().BitLen(), x.Denom().BitLen())
+	if exp.BitLen() > 32 || int64(bits)*exp.Int64() > maxPowBits {
+		return Number{}, Errorf(CodeDomainError, "result of %s ^ %s is too large", x.RatString(), y.RatString())
+	}
+	num := new(big.Int).Exp(x.Num(), exp, nil)
+	den := new(big.Int).Exp(x.Denom(), exp, nil)
+	if y.Sign() < 0 {
+		if num.Sign() == 0 {
+			return Number{}, errDivisionByZero
+		}
+		num, den = den, num
+	}
+	r := new(big.Rat).SetFrac(num, den)
+	return m.finish(r, x.RatString()+" ^ "+y.RatString())
+}
+
+// Sqrt is exact for perfect squares, decimal mode rounds all others
+func (m exactMode) Sqrt(n Number) (Number, error) {
+	x := n.r
+	if x.Sign() < 0 {
+		return Number{}, Errorf(CodeDomainError, "sqrt of negative number %s", x.RatString())
+	}
+	num, den := new(big.Int).Sqrt(x.Num()), new(big.Int).Sqrt(x.Denom())
+	if new(big.Int).Mul(num, num).Cmp(x.Num()) == 0 && new(big.Int).Mul(den, den).Cmp(x.Denom()) == 0 {
+		return m.finish(new(big.Rat).SetFrac(num, den), "sqrt("+x.RatString()+")")
+	}
+	if m.kind != "decimal" {
+		return Number{}, Errorf(CodeInexact, "sqrt(%s) is irrational, use decimal mode", x.RatString())
+	}
+	// floor(sqrt(x * 10^(2k))) / 10^k with one guard digit, then rounded
+	k := int64(m.scale + 1)
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(2*k), nil)
+	scaled := new(big.Int).Mul(x.Num(), pow)
+	scaled.Quo(scaled, x.Denom())
+	root := new(big.Int).Sqrt(scaled)
+	r := new(big.Rat).SetFrac(root, new(big.Int).Exp(big.NewInt(10), big.NewInt(k), nil))
+	return m.finish(r, "")
+}
+
+func (m exactMode) Format(n Number) string {
+	switch m.kind {
+	case "int":
+		return n.r.Num().String()
+	case "decimal":
+		s := n.r.FloatString(m.scale)
+		if strings.Contains(s, ".") {
+			s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		}
+		return s
+	}
+	return n.r.RatString()
+}
+
+// roundRat rounds r half to even to scale digits after the decimal point
+func roundRat(r *big.Rat, scale int) *big.Rat {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	num := new(big.Int).Mul(new(big.Int).Abs(r.Num()), pow)
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	switch rem.Lsh(rem, 1).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return new(big.Rat).SetFrac(q, pow)
+}
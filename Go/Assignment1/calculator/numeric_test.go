@@ -0,0 +1,172 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		spec, want string // the mode's name, or the error code after "!"
+	}{
+		{"float", "float"},
+		{"int", "int"},
+		{"rat", "rat"},
+		{"decimal", "decimal:20"},
+		{"decimal:4", "decimal:4"},
+		{"decimal:0", "decimal:0"},
+		{"decimal:1001", "!" + CodeInvalidMode},
+		{"decimal:-1", "!" + CodeInvalidMode},
+		{"decimal:x", "!" + CodeInvalidMode},
+		{"int:2", "!" + CodeInvalidMode},
+		{"hex", "!" + CodeInvalidMode},
+		{"", "!" + CodeInvalidMode},
+	}
+	for _, tt := range tests {
+		mode, err := ParseMode(tt.spec)
+		switch {
+		case err != nil:
+			if "!"+errorCode(err) != tt.want {
+				t.Errorf("ParseMode(%q): %v, want %s", tt.spec, err, tt.want)
+			}
+		case mode.Name() != tt.want:
+			t.Errorf("ParseMode(%q) = %s, want %s", tt.spec, mode.Name(), tt.want)
+		}
+	}
+}
+
+// TestModes evaluates the same kinds of expressions in every numeric mode
+func TestModes(t *testing.T) {
+	tests := []struct {
+		mode, expr string
+		want       string // formatted result, or the error code after "!"
+	}{
+		{"float", "1 / 3", "0.333333"},
+		{"float", "0.1 + 0.2", "0.300000"},
+		{"float", "2 ^ 0.5", "1.414214"},
+		{"float", "sqrt(2)", "1.414214"},
+		{"float", "-7 % 3", "-1.000000"},
+		{"float", "min(1 / 3, 0.3)", "0.300000"},
+		{"float", "abc", "!" + CodeUnknownName},
+
+		{"int", "6 / 2", "3"},
+		{"int", "7 / 2", "!" + CodeInexact},
+		{"int", "2 ^ 100", "1267650600228229401496703205376"},
+		{"int", "2 ^ -1", "!" + CodeInexact},
+		{"int", "-7 % 3", "-1"},
+		{"int", "sqrt(144)", "12"},
+		{"int", "sqrt(2)", "!" + CodeInexact},
+		{"int", "1.5", "!" + CodeInvalidNumber},
+		{"int", "max(-3, -4)", "-3"},
+
+		{"rat", "1/3 + 1/6", "1/2"},
+		{"rat", "0.1 + 0.2", "3/10"},
+		{"rat", "2 ^ -2", "1/4"},
+		{"rat", "(2/3) ^ 2", "4/9"},
+		{"rat", "2 ^ (1/2)", "!" + CodeInexact},
+		{"rat", "0 ^ -1", "!" + CodeDivisionByZero},
+		{"rat", "2 ^ 100000000", "!" + CodeDomainError},
+		{"rat", "7/2 % 1", "1/2"},
+		{"rat", "sqrt(9/4)", "3/2"},
+		{"rat", "sqrt(-4)", "!" + CodeDomainError},
+		{"rat", "min(1/2, 1/3)", "1/3"},
+		{"rat", "1e99999", "!" + CodeInvalidNumber},
+
+		{"decimal:4", "1 / 3", "0.3333"},
+		{"decimal:4", "2 / 3", "0.6667"},
+		{"decimal:4", "0.00005 + 0", "0"},
+		{"decimal:4", "0.00015 + 0", "0.0002"},
+		{"decimal:4", "-0.00015 + 0", "-0.0002"},
+		{"decimal:4", "1.5 * 2", "3"},
+		{"decimal:4", "sqrt(2)", "1.4142"},
+		{"decimal:0", "5 / 2", "2"},
+		{"decimal:0", "7 / 2", "4"},
+		{"decimal:20", "sqrt(2)", "1.4142135623730950488"},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := Evaluate(tt.expr, mode, nil)
+		checkResult(t, fmt.Sprintf("Evaluate(%q)", tt.expr), mode, got, err, tt.want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		mode, s, want string
+	}{
+		{"rat", "-1/3", "-1/3"},
+		{"rat", "2.5e3", "2500"},
+		{"int", "12", "12"},
+		{"decimal:2", "0.126", "0.13"},
+		{"rat", "1e10001", "!" + CodeInvalidNumber},
+		// Base prefixes, whose binary exponents are not bounded like e
+		{"rat", "0x1p9999999", "!" + CodeInvalidNumber},
+		{"rat", "-0x1P-9999999", "!" + CodeInvalidNumber},
+		{"rat", "0x10", "!" + CodeInvalidNumber},
+		{"int", "0b101", "!" + CodeInvalidNumber},
+		{"int", "+0o17", "!" + CodeInvalidNumber},
+		{"rat", "1/0x3", "!" + CodeInvalidNumber},
+		{"decimal:2", "0X1p3", "!" + CodeInvalidNumber},
+		{"rat", "1p3", "!" + CodeInvalidNumber},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := mode.Parse(tt.s)
+		checkResult(t, fmt.Sprintf("Parse(%q)", tt.s), mode, got, err, tt.want)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	third := mustParse(t, mustParseMode(t, "rat"), "1/3")
+	tests := []struct {
+		mode string
+		n    Number
+		want string // formatted result, or the error code after "!"
+	}{
+		{"float", third, "0.333333"},
+		{"rat", Number{f: 0.5}, "1/2"},
+		{"int", Number{f: 4}, "4"},
+		{"int", Number{f: 2.5}, "!" + CodeInexact},
+		{"int", third, "!" + CodeInexact},
+		{"decimal:2", third, "0.33"},
+		{"rat", Number{f: math.Inf(1)}, "!" + CodeDomainError},
+		{"decimal:2", Number{f: math.NaN()}, "!" + CodeDomainError},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := mode.Convert(tt.n)
+		checkResult(t, fmt.Sprintf("Convert(%v)", tt.n), mode, got, err, tt.want)
+	}
+}
+
+func TestNumberText(t *testing.T) {
+	tests := []struct {
+		n    Number
+		text string
+	}{
+		{Number{f: 0.1}, "f:0.1"},
+		{Number{f: -2}, "f:-2"},
+		{mustParse(t, mustParseMode(t, "rat"), "1/3"), "r:1/3"},
+		{mustParse(t, mustParseMode(t, "int"), "-12"), "r:-12"},
+	}
+	for _, tt := range tests {
+		text, err := tt.n.MarshalText()
+		if err != nil || string(text) != tt.text {
+			t.Errorf("MarshalText(%v) = %s, %v, want %s", tt.n, text, err, tt.text)
+			continue
+		}
+		var back Number
+		if err := back.UnmarshalText(text); err != nil {
+			t.Errorf("UnmarshalText(%s): %v", text, err)
+		} else if back.Exact() != tt.n.Exact() || back.Float64() != tt.n.Float64() {
+			t.Errorf("UnmarshalText(%s) = %v, want %v", text, back, tt.n)
+		}
+	}
+	for _, text := range []string{"", "f:x", "r:1/0", "x:1"} {
+		var n Number
+		if err := n.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %v, want an error", text, n)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package calculator evaluates the commands of the server. The server
+// evaluates every command through Calculate, for the TCP protocols and the
+// HTTP gateway alike, and the peers and the load generator draw their
+// requests from the same operations.
+//
+// Commands of the form <name> <x> <y> are the registered operations of
+// Command syntax, and must have as many arguments as the operation; anything
+// else is an expression, whose operators and functions are registered
+// operations too. An operation is added by
+// registering it, e.g.
+//
+//	RegisterOperation(Operation{Name: "avg", Syntax: Function, Arity: 2, Eval: func(mode Mode, args []Number) (Number, error) {
+//		sum, err := mode.Add(args[0], args[1])
+//		if err != nil {
+//			return Number{}, err
+//		}
+//		two, _ := mode.Parse("2")
+//		return mode.Quo(sum, two)
+//	}})
+//
+// which makes avg(x, y) available in expressions. The name of a Command
+// operation is also an operation identities can be allowed, see
+// cmd/server/auth.go.
+package calculator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Error codes of the calculator, part of those of the JSON protocol
+const (
+	CodeInvalidFormat  = "invalid_format" // the command is malformed
+	CodeInvalidNumber  = "invalid_number" // an operand is not a number
+	CodeSyntaxError    = "syntax_error"   // the expression cannot be parsed
+	CodeUnknownName    = "unknown_name"   // undefined variable or function
+	CodeDivisionByZero = "division_by_zero"
+	CodeDomainError    = "domain_error" // e.g. sqrt of a negative number, infinite results
+	CodeInexact        = "inexact"      // the result cannot be represented exactly in the numeric mode
+	CodeInvalidMode    = "invalid_mode" // unknown numeric mode or precision
+)
+
+// Syntax is how an operation is written
+type Syntax int
+
+const (
+	Command  Syntax = iota // <name> <x> <y>, as a whole command
+	Function               // <name>(<x>, <y>) in expressions
+	Operator               // <x> <name> <y> in expressions, fixed by their grammar
+)
+
+// Operation is an operation on numbers evaluated in a numeric mode
+type Operation struct {
+	Name   string
+	Syntax Syntax
+	Arity  int                                            // number of arguments
+	Eval   func(mode Mode, args []Number) (Number, error) // called with Arity arguments
+}
+
+// UsageError is a complaint about the command itself, answered verbatim
+// rather than as "Error: ..."
+type UsageError string
+
+func (e UsageError) Error() string {
+	return string(e)
+}
+
+func (e UsageError) Code() string {
+	switch e {
+	case errInvalidNumbers:
+		return CodeInvalidNumber
+	}
+	return CodeInvalidFormat
+}
+
+const (
+	errInvalidFormat  = UsageError("Invalid format. Use <operation> <x> <y> or an expression")
+	errInvalidNumbers = UsageError("Invalid numbers provided.")
+)
+
+// operationsByName are the registered operations, and commands those of
+// Command syntax in the order they were registered, which RandomOperation
+// chooses from
+var (
+	operationsByName = make(map[string]*Operation)
+	commands         []*Operation
+)
+
+func init() {
+	for _, op := range []Operation{
+		{Name: "add", Syntax: Command, Arity: 2, Eval: binary(Mode.Add)},
+		{Name: "sub", Syntax: Command, Arity: 2, Eval: binary(Mode.Sub)},
+		{Name: "mul", Syntax: Command, Arity: 2, Eval: binary(Mode.Mul)},
+		{Name: "div", Syntax: Command, Arity: 2, Eval: binary(Mode.Quo)},
+		{Name: "+", Syntax: Operator, Arity: 2, Eval: binary(Mode.Add)},
+		{Name: "-", Syntax: Operator, Arity: 2, Eval: binary(Mode.Sub)},
+		{Name: "*", Syntax: Operator, Arity: 2, Eval: binary(Mode.Mul)},
+		{Name: "/", Syntax: Operator, Arity: 2, Eval: binary(Mode.Quo)},
+		{Name: "%", Syntax: Operator, Arity: 2, Eval: binary(Mode.Rem)},
+		{Name: "^", Syntax: Operator, Arity: 2, Eval: binary(Mode.Pow)},
+		{Name: "neg", Syntax: Operator, Arity: 1, Eval: unary(Mode.Neg)},
+		{Name: "sqrt", Syntax: Function, Arity: 1, Eval: unary(Mode.Sqrt)},
+		{Name: "pow", Syntax: Function, Arity: 2, Eval: binary(Mode.Pow)},
+		{Name: "mod", Syntax: Function, Arity: 2, Eval: binary(Mode.Rem)},
+		{Name: "min", Syntax: Function, Arity: 2, Eval: func(mode Mode, args []Number) (Number, error) {
+			if mode.Cmp(args[1], args[0]) < 0 {
+				return args[1], nil
+			}
+			return args[0], nil
+		}},
+		{Name: "max", Syntax: Function, Arity: 2, Eval: func(mode Mode, args []Number) (Number, error) {
+			if mode.Cmp(args[1], args[0]) > 0 {
+				return args[1], nil
+			}
+			return args[0], nil
+		}},
+	} {
+		register(op)
+	}
+}
+
+// unary evaluates an operation of one argument by a method of Mode, e.g.
+// Mode.Neg
+func unary(method func(mode Mode, x Number) (Number, error)) func(Mode, []Number) (Number, error) {
+	return func(mode Mode, args []Number) (Number, error) {
+		return method(mode, args[0])
+	}
+}
+
+// binary evaluates an operation of two arguments by a method of Mode, e.g.
+// Mode.Add
+func binary(method func(mode Mode, x, y Number) (Number, error)) func(Mode, []Number) (Number, error) {
+	return func(mode Mode, args []Number) (Number, error) {
+		return method(mode, args[0], args[1])
+	}
+}
+
+// RegisterOperation adds a command or function. Like flag definitions it is
+// meant for program start, and panics on an invalid or duplicate operation.
+// Operators are fixed by the grammar of expressions and cannot be added.
+func RegisterOperation(op Operation) {
+	if op.Syntax != Command && op.Syntax != Function {
+		panic(fmt.Sprintf("operation %s is neither a command nor a function", op.Name))
+	}
+	register(op)
+}
+
+func register(op Operation) {
+	switch {
+	case op.Name == "" || strings.ContainsAny(op.Name, " \t(),"):
+		panic(fmt.Sprintf("invalid operation name %q", op.Name))
+	case op.Arity < 1 || op.Eval == nil:
+		panic(fmt.Sprintf("operation %s needs arguments and Eval", op.Name))
+	case operationsByName[op.Name] != nil:
+		panic(fmt.Sprintf("operation %s registered twice", op.Name))
+	}
+	operationsByName[op.Name] = &op
+	if op.Syntax == Command {
+		commands = append(commands, &op)
+	}
+}
+
+// LookupOperation returns the operation called name, of any syntax, or nil
+func LookupOperation(name string) *Operation {
+	return operationsByName[name]
+}
+
+// Calculate evaluates command in mode: an operation of Command syntax, whose
+// arguments are numbers or names in vars, or else an expression
+func Calculate(command string, mode Mode, vars map[string]Number) (Number, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return Number{}, errInvalidFormat
+	}
+	op := LookupOperation(fields[0])
+	if op == nil || op.Syntax != Command {
+		return Evaluate(command, mode, vars)
+	}
+	if len(fields) != 1+op.Arity {
+		return Number{}, errInvalidFormat
+	}
+	args := make([]Number, op.Arity)
+	for i, arg := range fields[1:] {
+		var err error
+		if v, ok := vars[arg]; ok {
+			args[i], err = mode.Convert(v)
+		} else {
+			args[i], err = mode.Parse(arg)
+		}
+		if err != nil {
+			return Number{}, errInvalidNumbers
+		}
+	}
+	return op.Eval(mode, args)
+}
+
+// RandomOperation generates a random command of a registered operation
+func RandomOperation() string {
+	return randomOperation(rand.Intn, rand.Float64)
+}
+
+// RandomOperationFrom is RandomOperation drawing from rng, for reproducible
+// sequences of operations
+func RandomOperationFrom(rng *rand.Rand) string {
+	return randomOperation(rng.Intn, rng.Float64)
+}
+
+func randomOperation(intn func(int) int, float func() float64) string {
+	op := commands[intn(len(commands))]
+	fields := []string{op.Name}
+	for range op.Arity {
+		fields = append(fields, fmt.Sprintf("%.2f", float()*10))
+	}
+	return strings.Join(fields, " ")
+}
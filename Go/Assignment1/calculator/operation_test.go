@@ -0,0 +1,211 @@
+package calculator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// errorCode returns the protocol error code of err, empty for nil
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if coded, ok := err.(interface{ Code() string }); ok {
+		return coded.Code()
+	}
+	return "uncoded"
+}
+
+func mustParseMode(t *testing.T, spec string) Mode {
+	t.Helper()
+	mode, err := ParseMode(spec)
+	if err != nil {
+		t.Fatalf("ParseMode(%q): %v", spec, err)
+	}
+	return mode
+}
+
+func mustParse(t *testing.T, mode Mode, s string) Number {
+	t.Helper()
+	n, err := mode.Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q) in %s: %v", s, mode.Name(), err)
+	}
+	return n
+}
+
+// checkResult compares a result in mode to want, the formatted number or the
+// error code after "!"
+func checkResult(t *testing.T, call string, mode Mode, got Number, err error, want string) {
+	t.Helper()
+	if code, ok := strings.CutPrefix(want, "!"); ok {
+		if errorCode(err) != code {
+			t.Errorf("%s in %s = %v, want error %s", call, mode.Name(), err, code)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s in %s: %v", call, mode.Name(), err)
+	} else if mode.Format(got) != want {
+		t.Errorf("%s in %s = %s, want %s", call, mode.Name(), mode.Format(got), want)
+	}
+}
+
+func TestLookupOperation(t *testing.T) {
+	tests := []struct {
+		name   string
+		syntax Syntax
+		arity  int
+	}{
+		{"add", Command, 2},
+		{"sub", Command, 2},
+		{"mul", Command, 2},
+		{"div", Command, 2},
+		{"+", Operator, 2},
+		{"-", Operator, 2},
+		{"*", Operator, 2},
+		{"/", Operator, 2},
+		{"%", Operator, 2},
+		{"^", Operator, 2},
+		{"neg", Operator, 1},
+		{"sqrt", Function, 1},
+		{"pow", Function, 2},
+		{"mod", Function, 2},
+		{"min", Function, 2},
+		{"max", Function, 2},
+	}
+	for _, tt := range tests {
+		op := LookupOperation(tt.name)
+		if op == nil {
+			t.Errorf("LookupOperation(%q) = nil", tt.name)
+			continue
+		}
+		if op.Name != tt.name || op.Syntax != tt.syntax || op.Arity != tt.arity {
+			t.Errorf("LookupOperation(%q) = %s with syntax %d and arity %d, want syntax %d and arity %d",
+				tt.name, op.Name, op.Syntax, op.Arity, tt.syntax, tt.arity)
+		}
+	}
+	if op := LookupOperation("avg"); op != nil {
+		t.Errorf("LookupOperation(avg) = %s, want nil", op.Name)
+	}
+}
+
+func TestRegisterOperation(t *testing.T) {
+	eval := func(mode Mode, args []Number) (Number, error) {
+		sum, err := mode.Add(args[0], args[1])
+		if err != nil {
+			return Number{}, err
+		}
+		two, _ := mode.Parse("2")
+		return mode.Quo(sum, two)
+	}
+	// The registry outlives the test, e.g. with -count 2
+	if LookupOperation("mean") == nil {
+		RegisterOperation(Operation{Name: "mean", Syntax: Function, Arity: 2, Eval: eval})
+		RegisterOperation(Operation{Name: "half", Syntax: Command, Arity: 2, Eval: eval})
+	}
+
+	tests := []struct {
+		command, mode, want string
+	}{
+		{"mean(1, 2)", "rat", "3/2"},
+		{"mean(1, 2) * 2", "float", "3.000000"},
+		{"half 1 2", "rat", "3/2"},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := Calculate(tt.command, mode, nil)
+		checkResult(t, fmt.Sprintf("Calculate(%q)", tt.command), mode, got, err, tt.want)
+	}
+	if _, err := Calculate("mean 1 2", DefaultMode, nil); errorCode(err) != CodeUnknownName {
+		t.Errorf("Calculate(mean 1 2) = %v, want %s: functions are not commands", err, CodeUnknownName)
+	}
+}
+
+func TestRegisterOperationPanics(t *testing.T) {
+	eval := func(mode Mode, args []Number) (Number, error) { return args[0], nil }
+	tests := []struct {
+		desc string
+		op   Operation
+	}{
+		{"empty name", Operation{Syntax: Command, Arity: 1, Eval: eval}},
+		{"space in name", Operation{Name: "a b", Syntax: Command, Arity: 1, Eval: eval}},
+		{"parenthesis in name", Operation{Name: "f(", Syntax: Function, Arity: 1, Eval: eval}},
+		{"no arguments", Operation{Name: "zero", Syntax: Command, Eval: eval}},
+		{"no Eval", Operation{Name: "noop", Syntax: Command, Arity: 1}},
+		{"duplicate", Operation{Name: "add", Syntax: Command, Arity: 2, Eval: eval}},
+		{"operator", Operation{Name: "&", Syntax: Operator, Arity: 2, Eval: eval}},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterOperation with %s did not panic", tt.desc)
+				}
+			}()
+			RegisterOperation(tt.op)
+		}()
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	vars := map[string]Number{"a": mustParse(t, DefaultMode, "2"), "third": mustParse(t, mustParseMode(t, "rat"), "1/3")}
+	tests := []struct {
+		command, mode string
+		want          string // formatted result, or the error code after "!"
+	}{
+		{"add 2 3", "float", "5.000000"},
+		{"sub 2 3", "float", "-1.000000"},
+		{"mul 2.5 4", "float", "10.000000"},
+		{"div 1 4", "float", "0.250000"},
+		{"div 1 3", "rat", "1/3"},
+		{"div 1 3", "int", "!" + CodeInexact},
+		{"div 1 0", "float", "!" + CodeDivisionByZero},
+		{"add a 1", "float", "3.000000"},
+		{"add a third", "rat", "7/3"},
+		{"add third 0", "float", "0.333333"},
+		{"add 1 x", "float", "!" + CodeInvalidNumber},
+		{"add 1.5 1", "int", "!" + CodeInvalidNumber},
+		{"add 0x1p9999999 1", "rat", "!" + CodeInvalidNumber},
+		{"", "float", "!" + CodeInvalidFormat},
+		{"   ", "float", "!" + CodeInvalidFormat},
+		// A command takes exactly the arguments of its operation, anything
+		// not starting with one is an expression
+		{"add 1", "float", "!" + CodeInvalidFormat},
+		{"add 1 2 3", "float", "!" + CodeInvalidFormat},
+		{"div", "rat", "!" + CodeInvalidFormat},
+		{"sqrt 4", "float", "!" + CodeUnknownName},
+		{"a * 3", "float", "6.000000"},
+	}
+	for _, tt := range tests {
+		mode := mustParseMode(t, tt.mode)
+		got, err := Calculate(tt.command, mode, vars)
+		checkResult(t, fmt.Sprintf("Calculate(%q)", tt.command), mode, got, err, tt.want)
+	}
+	// Not evaluated as expressions, which would fail on the name
+	for _, command := range []string{"add 1", "mul 1 2 3"} {
+		if _, err := Calculate(command, DefaultMode, nil); err != errInvalidFormat {
+			t.Errorf("Calculate(%q) = %v, want %v", command, err, errInvalidFormat)
+		}
+	}
+}
+
+func TestRandomOperationFrom(t *testing.T) {
+	a, b := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	for range 100 {
+		command := RandomOperationFrom(a)
+		if other := RandomOperationFrom(b); other != command {
+			t.Fatalf("the same seed generated %q and %q", command, other)
+		}
+		fields := strings.Fields(command)
+		op := LookupOperation(fields[0])
+		if op == nil || op.Syntax != Command || len(fields) != 1+op.Arity {
+			t.Fatalf("RandomOperationFrom generated %q, not a registered command", command)
+		}
+		if _, err := Calculate(command, DefaultMode, nil); err != nil && errorCode(err) != CodeDivisionByZero {
+			t.Errorf("Calculate(%q): %v", command, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "sd/Assignment1/protocol"
+    "sd/transport"
+)
+
+// failoverDelay gives a backup time to take over from a failed primary
+const failoverDelay = 500 * time.Millisecond
+
+// client is a connection to the primary server that moves on to the next
+// replica when the server fails, resuming its session there
+type client struct {
+    servers   *protocol.ServerList
+    json      bool
+    token     string // sent with AUTH on every connection, if set
+    transport *transport.Transport
+    conn      net.Conn
+    scanner   *bufio.Scanner
+    session   string
+    id        uint64
+    key       string // prefix of the request keys, unique to this run
+    keys      uint64
+}
+
+func main() {
+    jsonProtocol := flag.Bool("json", false, "use the server's JSON protocol instead of plain text")
+    file := flag.String("file", "", "run the commands of a script file and exit, see script.go")
+    batch := flag.Bool("batch", false, "run the commands read from standard input as a script, the default unless it is a terminal")
+    token := flag.String("token", "", "API token to authenticate to a server running with -auth")
+    var tlsFiles transport.TLSFiles
+    tlsFiles.AddFlags()
+    flag.Parse()
+    var servers string
+    switch flag.NArg() {
+    case 1:
+        servers = flag.Arg(0)
+    case 2:
+        servers = net.JoinHostPort(flag.Arg(0), flag.Arg(1))
+    default:
+        fmt.Println("Usage: go run ./cmd/client [flags] <server IP> <server Port>")
+        fmt.Println("       go run ./cmd/client [flags] <host:port>[,<host:port>...]")
+        os.Exit(exitUsage)
+    }
+
+    input := os.Stdin
+    if *file != "" {
+        f, err := os.Open(*file)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "Error opening script:", err)
+            os.Exit(exitUsage)
+        }
+        defer f.Close()
+        input = f
+        *batch = true
+    } else if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+        *batch = true // Piped input
+    }
+
+    // Scripts always use the JSON protocol, for the error codes
+    c := &client{servers: protocol.NewServerList(servers), json: *jsonProtocol || *batch, token: *token, key: fmt.Sprintf("client-%x", time.Now().UnixNano())}
+    var err error
+    if c.transport, err = transport.New(tlsFiles, tls.NoClientCert); err != nil {
+        fmt.Fprintln(os.Stderr, "Error loading TLS certificates:", err)
+        os.Exit(exitUsage)
+    }
+    if err := c.connect(); err != nil {
+        fmt.Fprintln(os.Stderr, "Error connecting to server:", err)
+        os.Exit(exitConnection)
+    }
+    defer func() { c.conn.Close() }()
+
+    if *batch {
+        status := runScript(c, input, os.Stdout)
+        c.conn.Close()
+        os.Exit(status)
+    }
+
+    reader := bufio.NewReader(input)
+    for {
+        fmt.Print("$ ")
+        command, err := reader.ReadString('\n')
+        if err != nil && command == "" {
+            fmt.Println()
+            break // End of input
+        }
+        command = strings.TrimSpace(command)
+
+        if command == "quit" {
+            break
+        }
+
+        line, err := c.call(command)
+        if err != nil {
+            fmt.Println("Error talking to server:", err)
+            break
+        }
+        if !c.json {
+            fmt.Printf("Result: %s\n", line)
+            continue
+        }
+        var resp protocol.Response
+        if err := json.Unmarshal([]byte(line), &resp); err != nil {
+            fmt.Println("Invalid response:", line)
+            continue
+        }
+        switch {
+        case resp.Error != nil:
+            fmt.Printf("Error (%s): %s\n", resp.Error.Code, resp.Error.Message)
+        case resp.Value != "":
+            fmt.Printf("Result: %s\n", resp.Value)
+        case resp.Result != nil:
+            fmt.Printf("Result: %g\n", *resp.Result)
+        default:
+            fmt.Println(resp.Text)
+        }
+    }
+}
+
+// call sends a command and returns the response line, failing over to the
+// next server until one answers it and waiting while the server is busy. The
+// command carries a request key, so a server that already executed it before
+// failing is not asked to run it twice.
+func (c *client) call(command string) (string, error) {
+    c.keys++
+    key := fmt.Sprintf("%s-%d", c.key, c.keys)
+    for {
+        line, err := c.roundTrip(key, command)
+        if err == nil {
+            if retryAfter, ok := protocol.Busy(line); ok {
+                fmt.Fprintf(os.Stderr, "Server busy, retrying in %v\n", retryAfter)
+                time.Sleep(retryAfter)
+                continue
+            }
+            if _, ok := protocol.NotPrimary(line); !ok {
+                return line, nil
+            }
+        }
+        fmt.Fprintf(os.Stderr, "Server %s failed, reconnecting...\n", c.servers.Primary())
+        c.conn.Close()
+        if err := c.connect(); err != nil {
+            return "", err
+        }
+    }
+}
+
+// connect connects to the primary, trying each server in turn
+func (c *client) connect() error {
+    var err error
+    for attempt := 0; attempt < 2*len(c.servers.All()); attempt++ {
+        if attempt > 0 {
+            time.Sleep(failoverDelay)
+        }
+        addr := c.servers.Primary()
+        var hint string
+        if hint, err = c.dial(addr); err == nil {
+            fmt.Fprintf(os.Stderr, "Connected to server: %s\n", addr)
+            return nil
+        }
+        c.servers.Failover(addr, hint)
+    }
+    return err
+}
+
+// dial opens a connection to addr, authenticates, negotiates the protocol
+// and starts or resumes the session. A backup's answer names the primary as
+// hint.
+func (c *client) dial(addr string) (hint string, err error) {
+    conn, err := c.transport.Dial(addr)
+    if err != nil {
+        return "", err
+    }
+    c.conn = conn
+    c.scanner = bufio.NewScanner(conn)
+    if c.token != "" {
+        fmt.Fprintln(conn, "AUTH "+c.token)
+        if !c.scanner.Scan() {
+            conn.Close()
+            return "", fmt.Errorf("%s closed the connection while authenticating", addr)
+        }
+        name, ok := strings.CutPrefix(c.scanner.Text(), "OK ")
+        if !ok {
+            conn.Close()
+            return "", fmt.Errorf("%s refused the token: %s", addr, c.scanner.Text())
+        }
+        fmt.Fprintf(os.Stderr, "Authenticated as %s\n", name)
+    }
+    if c.json {
+        fmt.Fprintln(conn, "PROTOCOL json")
+        if !c.scanner.Scan() || c.scanner.Text() != "OK json" {
+            conn.Close()
+            return "", fmt.Errorf("%s does not support the JSON protocol", addr)
+        }
+    }
+
+    command := "SESSION"
+    if c.session != "" {
+        command += " " + c.session
+    }
+    for {
+        line, err := c.roundTrip("", command)
+        if err != nil {
+            conn.Close()
+            return "", err
+        }
+        if primary, ok := protocol.NotPrimary(line); ok {
+            conn.Close()
+            return primary, fmt.Errorf("%s is %s", addr, protocol.NotPrimaryMessage)
+        }
+        if c.json {
+            var resp protocol.Response
+            json.Unmarshal([]byte(line), &resp)
+            if resp.Error != nil && resp.Error.Code != protocol.CodeUnknownSession {
+                conn.Close()
+                return "", fmt.Errorf("%s refused the session: %s", addr, resp.Error.Message)
+            }
+            line = resp.Text
+        }
+        if id, ok := strings.CutPrefix(line, "Session "); ok {
+            c.session = id
+            return "", nil
+        }
+        if command == "SESSION" {
+            conn.Close()
+            return "", fmt.Errorf("unexpected answer %q", line)
+        }
+        fmt.Fprintln(os.Stderr, "Session lost, variables and history start over")
+        command = "SESSION"
+    }
+}
+
+// roundTrip sends a command with an optional request key over the current
+// connection and reads the response line
+func (c *client) roundTrip(key, command string) (string, error) {
+    line := command
+    if key != "" {
+        line = "REQUEST " + key + " " + command
+    }
+    if c.json {
+        c.id++
+        data, _ := json.Marshal(protocol.Request{ID: c.id, Key: key, Command: command})
+        line = string(data)
+    }
+    if _, err := fmt.Fprintln(c.conn, line); err != nil {
+        return "", err
+    }
+    if !c.scanner.Scan() {
+        if err := c.scanner.Err(); err != nil {
+            return "", err
+        }
+        return "", fmt.Errorf("connection closed by server")
+    }
+    return c.scanner.Text(), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"sd/Assignment1/protocol"
+)
+
+// Scripts are run by the client with -file, or when its input is piped. Each
+// line is a command, blank lines and lines starting with # are skipped, and
+// "quit" ends the script. A command may end in an assertion on its response:
+//
+//	let a = add 2 3      --expect 5
+//	@rat a / 3           --expect 5/3
+//	mode int             --expect Mode: int
+//	1 / 0                --expect error:division_by_zero
+//	sqrt(-1)             --expect error
+//
+// A number matches a result that differs by a relative 1e-9 at most, other
+// text the exact value or text of the response, and "error" any error. A
+// command without --expect fails if it gets an error. Every command prints
+// one scriptResult as a JSON line, and the client exits with exitFailed if
+// any failed.
+
+// Exit statuses of the client
+const (
+	exitOK         = 0
+	exitFailed     = 1 // a command of the script failed
+	exitUsage      = 2
+	exitConnection = 3 // no server could be reached
+)
+
+// scriptResult is the outcome of a script command
+type scriptResult struct {
+	Line    int                     `json:"line"`
+	Command string                  `json:"command"`
+	Result  *float64                `json:"result,omitempty"`
+	Value   string                  `json:"value,omitempty"`
+	Mode    string                  `json:"mode,omitempty"`
+	Text    string                  `json:"text,omitempty"`
+	Error   *protocol.ResponseError `json:"error,omitempty"`
+	Expect  string                  `json:"expect,omitempty"`
+	Pass    bool                    `json:"pass"`
+	Failure string                  `json:"failure,omitempty"` // why the command failed
+}
+
+// runScript runs the commands read from r and writes their results to w,
+// returning the exit status
+func runScript(c *client, r io.Reader, w io.Writer) int {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	scanner := bufio.NewScanner(r)
+	commands, failed := 0, 0
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" {
+			break
+		}
+		command, expect, _ := strings.Cut(line, "--expect")
+		result := scriptResult{Line: n, Command: strings.TrimSpace(command), Expect: strings.TrimSpace(expect)}
+		commands++
+
+		reply, err := c.call(result.Command)
+		if err != nil {
+			result.Failure = err.Error()
+			enc.Encode(result)
+			fmt.Fprintf(os.Stderr, "Error talking to server: %v\n", err)
+			return exitConnection
+		}
+		var resp protocol.Response
+		if err := json.Unmarshal([]byte(reply), &resp); err != nil {
+			result.Failure = fmt.Sprintf("invalid response %q", reply)
+		} else {
+			result.Result, result.Value, result.Mode, result.Text, result.Error = resp.Result, resp.Value, resp.Mode, resp.Text, resp.Error
+			result.Failure = checkExpectation(resp, result.Expect)
+		}
+		result.Pass = result.Failure == ""
+		if !result.Pass {
+			failed++
+		}
+		enc.Encode(result)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading script: %v\n", err)
+		return exitUsage
+	}
+
+	fmt.Fprintf(os.Stderr, "%d commands, %d failed\n", commands, failed)
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// checkExpectation compares a response with the expected result, returning
+// why they differ or an empty string if they match
+func checkExpectation(resp protocol.Response, expect string) string {
+	if code, ok := strings.CutPrefix(expect, "error"); ok && (code == "" || code[0] == ':') {
+		switch {
+		case resp.Error == nil:
+			return "expected an error"
+		case code != "" && resp.Error.Code != code[1:]:
+			return fmt.Sprintf("expected error %s, got %s", code[1:], resp.Error.Code)
+		}
+		return ""
+	}
+	if resp.Error != nil {
+		return fmt.Sprintf("unexpected error %s: %s", resp.Error.Code, resp.Error.Message)
+	}
+	if expect == "" || resp.Value == expect || resp.Result == nil && resp.Text == expect {
+		return ""
+	}
+	if want, err := strconv.ParseFloat(expect, 64); err == nil && resp.Result != nil &&
+		math.Abs(*resp.Result-want) <= 1e-9*math.Max(1, math.Abs(want)) {
+		return ""
+	}
+	return "expected " + expect
+}
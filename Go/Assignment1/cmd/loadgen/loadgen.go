@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/poisson"
+	"sd/Assignment1/protocol"
+	"sd/transport"
+)
+
+// The load generator opens a number of client connections to the server and
+// sends RandomOperation requests over them in the pipelined JSON protocol.
+//
+// In open loop mode (the default) requests arrive as a Poisson process of
+// the given total rate, split evenly over the clients, whether or not earlier
+// requests were answered; latencies are measured from the scheduled arrival,
+// so a server falling behind shows up in them. In closed loop mode every
+// client sends its next request as soon as the previous one is answered, which
+// measures the throughput the server sustains with that many clients.
+//
+// The same -seed gives the same arrivals and operations in every run.
+
+// drainTimeout is how long responses are awaited after the last request
+const drainTimeout = 5 * time.Second
+
+// loadStats collects the outcome of the requests of one client
+type loadStats struct {
+	sent       int
+	latencies  []time.Duration // of the requests answered without error
+	errors     map[string]int  // error responses by code
+	unanswered map[string]int  // requests without response, by "connection" or "timeout"
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{errors: make(map[string]int), unanswered: make(map[string]int)}
+}
+
+// merge adds the outcome of another client
+func (s *loadStats) merge(o *loadStats) {
+	s.sent += o.sent
+	s.latencies = append(s.latencies, o.latencies...)
+	for code, n := range o.errors {
+		s.errors[code] += n
+	}
+	for reason, n := range o.unanswered {
+		s.unanswered[reason] += n
+	}
+}
+
+// loadClient is one connection of the load generator
+type loadClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	rng     *rand.Rand
+	stats   *loadStats
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time // requests without response, by ID, with their scheduled time
+	nextID  uint64
+}
+
+func dialLoadClient(transport *transport.Transport, addr string, seed int64, token string) (*loadClient, error) {
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &loadClient{conn: conn, scanner: bufio.NewScanner(conn), rng: rand.New(rand.NewSource(seed)),
+		stats: newLoadStats(), pending: make(map[uint64]time.Time)}
+	if token != "" {
+		fmt.Fprintln(conn, "AUTH "+token)
+		if !c.scanner.Scan() || !strings.HasPrefix(c.scanner.Text(), "OK ") {
+			conn.Close()
+			return nil, fmt.Errorf("%s refused the token: %s", addr, c.scanner.Text())
+		}
+	}
+	fmt.Fprintln(conn, "PROTOCOL pipeline")
+	if !c.scanner.Scan() || c.scanner.Text() != "OK pipeline" {
+		conn.Close()
+		return nil, fmt.Errorf("%s does not support the pipelined protocol", addr)
+	}
+	return c, nil
+}
+
+// send sends a random operation scheduled at the given time
+func (c *loadClient) send(scheduled time.Time) error {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = scheduled
+	c.stats.sent++
+	c.mu.Unlock()
+	data, _ := json.Marshal(protocol.Request{ID: id, Command: calculator.RandomOperationFrom(c.rng)})
+	_, err := fmt.Fprintf(c.conn, "%s\n", data)
+	return err
+}
+
+// receive reads one response and records its outcome
+func (c *loadClient) receive() error {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("connection closed by server")
+	}
+	now := time.Now()
+	var resp protocol.Response
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid response %q", c.scanner.Text())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	scheduled, ok := c.pending[resp.ID]
+	if !ok {
+		return fmt.Errorf("unexpected response %d", resp.ID)
+	}
+	delete(c.pending, resp.ID)
+	if resp.Error != nil {
+		c.stats.errors[resp.Error.Code]++
+	} else {
+		c.stats.latencies = append(c.stats.latencies, now.Sub(scheduled))
+	}
+	return nil
+}
+
+// runOpen sends requests at the arrivals of pp until the deadline, while
+// receiving the responses concurrently
+func (c *loadClient) runOpen(pp *poisson.Process, deadline time.Time) {
+	received := make(chan error, 1)
+	go func() {
+		for {
+			if err := c.receive(); err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	next := time.Now()
+	for {
+		next = next.Add(time.Duration(pp.TimeForNextEvent() * float64(time.Second)))
+		if next.After(deadline) {
+			break
+		}
+		time.Sleep(time.Until(next))
+		if err := c.send(next); err != nil {
+			break
+		}
+	}
+	c.finish(received)
+}
+
+// runClosed sends a request whenever the previous one is answered, until the
+// deadline
+func (c *loadClient) runClosed(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		if err := c.send(time.Now()); err != nil {
+			break
+		}
+		if err := c.receive(); err != nil {
+			break
+		}
+	}
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		c.stats.unanswered["connection"] += len(c.pending)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+// finish waits for the outstanding responses of an open loop client, and
+// counts those that do not come
+func (c *loadClient) finish(received chan error) {
+	c.conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	for {
+		c.mu.Lock()
+		outstanding := len(c.pending)
+		c.mu.Unlock()
+		if outstanding == 0 {
+			break
+		}
+		select {
+		case err := <-received:
+			reason := "connection"
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reason = "timeout"
+			}
+			c.mu.Lock()
+			c.stats.unanswered[reason] += len(c.pending)
+			c.pending = map[uint64]time.Time{}
+			c.mu.Unlock()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.conn.Close()
+}
+
+// percentile returns the p-th percentile of sorted latencies by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted)) + 0.999999)
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+func main() {
+	clients := flag.Int("clients", 10, "number of concurrent client connections")
+	mode := flag.String("mode", "open", "open (Poisson arrivals at -rate) or closed (next request once answered)")
+	rate := flag.Float64("rate", 100, "requests per second of all clients together in open loop mode")
+	duration := flag.Duration("duration", 10*time.Second, "how long requests are sent")
+	seed := flag.Int64("seed", 1, "random seed of the arrivals and operations")
+	token := flag.String("token", "", "API token to authenticate to a server running with -auth")
+	var tlsFiles transport.TLSFiles
+	tlsFiles.AddFlags()
+	flag.Parse()
+	if flag.NArg() != 1 || *clients < 1 || *mode != "open" && *mode != "closed" {
+		fmt.Println("Usage: go run ./cmd/loadgen [flags] <host:port>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	addr := flag.Arg(0)
+	transport, err := transport.New(tlsFiles, tls.NoClientCert)
+	if err != nil {
+		fmt.Println("Error loading TLS certificates:", err)
+		os.Exit(2)
+	}
+
+	conns := make([]*loadClient, *clients)
+	for i := range conns {
+		c, err := dialLoadClient(transport, addr, *seed+int64(i), *token)
+		if err != nil {
+			fmt.Println("Error connecting to server:", err)
+			os.Exit(1)
+		}
+		conns[i] = c
+	}
+	if *mode == "open" {
+		fmt.Printf("Sending %.1f requests/s from %d clients to %s for %v\n", *rate, *clients, addr, *duration)
+	} else {
+		fmt.Printf("Running %d closed loop clients against %s for %v\n", *clients, addr, *duration)
+	}
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if *mode == "open" {
+				// Seeded apart from the operations of the same client
+				c.runOpen(poisson.NewProcess(*rate/float64(*clients), *seed+int64(i)+1<<32), deadline)
+			} else {
+				c.runClosed(deadline)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := newLoadStats()
+	for _, c := range conns {
+		total.merge(c.stats)
+	}
+	report(total, elapsed)
+	if len(total.unanswered) > 0 {
+		os.Exit(1)
+	}
+}
+
+// report prints throughput, latency percentiles and errors
+func report(s *loadStats, elapsed time.Duration) {
+	slices.Sort(s.latencies)
+	var sum time.Duration
+	for _, l := range s.latencies {
+		sum += l
+	}
+	errors, unanswered := 0, 0
+	for _, n := range s.errors {
+		errors += n
+	}
+	for _, n := range s.unanswered {
+		unanswered += n
+	}
+
+	fmt.Printf("Requests:   %d sent, %d answered, %d with an error, %d unanswered in %v\n",
+		s.sent, len(s.latencies)+errors, errors, unanswered, elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f requests/s\n", float64(len(s.latencies)+errors)/elapsed.Seconds())
+	if len(s.latencies) > 0 {
+		fmt.Printf("Latency:    mean %v, p50 %v, p95 %v, p99 %v, max %v\n",
+			(sum / time.Duration(len(s.latencies))).Round(time.Microsecond),
+			percentile(s.latencies, 50).Round(time.Microsecond),
+			percentile(s.latencies, 95).Round(time.Microsecond),
+			percentile(s.latencies, 99).Round(time.Microsecond),
+			s.latencies[len(s.latencies)-1].Round(time.Microsecond))
+	}
+	printCounts("Errors:    ", s.errors)
+	printCounts("Unanswered:", s.unanswered)
+}
+
+// printCounts prints one line per key of counts, in sorted order
+func printCounts(label string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s %d %s\n", label, counts[key], key)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Leader election on the ring. An election runs at startup and whenever the
+// token has been silent for longer than tokenTimeout; the elected leader mints
+// the token of a new generation. The peer holding the token refuses to take
+// part, and should a slow token survive anyway it is discarded as stale once
+// it meets a peer that already saw the newer generation.
+//
+// Chang-Roberts (cr) messages travel clockwise only:
+//
+//	ELECT <gen> <id>, LEADER <gen> <id>
+//
+// Hirschberg-Sinclair (hs) probes both neighbours at doubling distances, which
+// needs the predecessor learned from HELLO messages:
+//
+//	PROBE <gen> <id> <phase> <hops> <cw|ccw>, REPLY <gen> <id> <phase> <cw|ccw>
+const (
+	clockwise        = "cw"  // towards the successor
+	counterClockwise = "ccw" // towards the predecessor
+)
+
+// maxPhase bounds the phase of probes, whose range of 2^phase hops must fit
+// an int
+const maxPhase = 62
+
+// handleElectionMessage dispatches election messages, it reports false for
+// messages that do not belong to the election
+func (p *Peer) handleElectionMessage(fields []string) bool {
+	if len(fields) < 3 {
+		return false
+	}
+	gen, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	switch {
+	case fields[0] == "ELECT" && len(fields) == 3:
+		p.handleElect(gen, fields[2])
+	case fields[0] == "LEADER" && len(fields) == 3:
+		p.handleLeader(gen, fields[2])
+	case fields[0] == "PROBE" && len(fields) == 6:
+		phase, err1 := strconv.Atoi(fields[3])
+		hops, err2 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || phase < 0 || phase > maxPhase || hops < 1 {
+			return false
+		}
+		p.handleProbe(gen, fields[2], phase, hops, fields[5])
+	case fields[0] == "REPLY" && len(fields) == 5:
+		phase, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return false
+		}
+		p.handleReply(gen, fields[2], phase, fields[4])
+	default:
+		return false
+	}
+	return true
+}
+
+// monitorToken periodically checks how long ago the token was seen and starts
+// an election when it has been silent for longer than tokenTimeout
+func (p *Peer) monitorToken() {
+	ticker := time.NewTicker(tokenTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.ringMu.Lock()
+		now := time.Now()
+		lost := !p.holding && !p.leaving &&
+			now.Sub(p.lastToken) > tokenTimeout &&
+			now.Sub(p.lastElection) > tokenTimeout &&
+			(!p.participant || now.Sub(p.electionStarted) > tokenTimeout)
+		p.ringMu.Unlock()
+
+		if lost {
+			log.Printf("Token silent for over %v, starting an election", tokenTimeout)
+			p.startElection()
+		}
+	}
+}
+
+// startElection puts this peer forward as candidate for the next generation.
+// An election that is still making progress is joined rather than replaced.
+func (p *Peer) startElection() {
+	p.ringMu.Lock()
+	if p.holding || time.Since(p.lastToken) < tokenTimeout {
+		p.ringMu.Unlock()
+		return
+	}
+	gen := p.electionGen
+	if gen <= p.generation || time.Since(p.lastElection) > tokenTimeout {
+		gen = max(p.generation, p.electionGen) + 1
+		p.resetElection(gen)
+	} else if p.sentOwn || p.hsPhase > 0 || p.hsReplies > 0 {
+		p.ringMu.Unlock()
+		return
+	}
+	p.participant = true
+	p.electionStarted = time.Now()
+	p.lastElection = p.electionStarted
+	algorithm := p.electionAlgorithm
+	if algorithm == "hs" && p.predecessor == "" {
+		log.Println("Predecessor unknown, falling back to Chang-Roberts")
+		algorithm = "cr"
+	}
+	p.ringMu.Unlock()
+
+	log.Printf("Starting %s election for generation %d", algorithm, gen)
+	if algorithm == "hs" {
+		p.sendProbes(gen, 0)
+		return
+	}
+	p.sendCandidacy(gen)
+}
+
+// resetElection forgets any earlier election, called with ringMu held
+func (p *Peer) resetElection(gen uint64) {
+	p.electionGen = gen
+	p.participant = false
+	p.sentOwn = false
+	p.hsPhase = 0
+	p.hsReplies = 0
+}
+
+// admitElection reports whether a message of election gen should be processed
+// and switches to that election if it is newer. Called with ringMu held.
+func (p *Peer) admitElection(gen uint64) bool {
+	switch {
+	case gen <= p.generation:
+		// A token of this generation or newer already exists
+		return false
+	case p.holding:
+		// The token is not lost
+		return false
+	case gen < p.electionGen:
+		return false
+	case gen > p.electionGen:
+		p.resetElection(gen)
+	}
+	p.lastElection = time.Now()
+	return true
+}
+
+// sendCandidacy sends this peer's own ELECT message clockwise
+func (p *Peer) sendCandidacy(gen uint64) {
+	if err := p.sendToSuccessor(fmt.Sprintf("ELECT %d %s", gen, p.ID)); err != nil {
+		log.Printf("Failed to send candidacy: %v", err)
+		return
+	}
+	p.ringMu.Lock()
+	if p.electionGen == gen {
+		p.sentOwn = true
+	}
+	p.ringMu.Unlock()
+}
+
+// handleElect applies the Chang-Roberts rules: higher IDs are passed on,
+// lower ones are replaced by our own, and an ID coming back home has won
+func (p *Peer) handleElect(gen uint64, candidate string) {
+	p.ringMu.Lock()
+	if !p.admitElection(gen) {
+		p.ringMu.Unlock()
+		return
+	}
+	switch {
+	case candidate == p.ID:
+		won := p.participant
+		p.ringMu.Unlock()
+		if won {
+			p.becomeLeader(gen)
+		}
+	case candidate > p.ID:
+		p.participant = true
+		p.ringMu.Unlock()
+		if err := p.sendToSuccessor(fmt.Sprintf("ELECT %d %s", gen, candidate)); err != nil {
+			log.Printf("Failed to forward candidacy of %s: %v", candidate, err)
+		}
+	default:
+		// Unlike textbook Chang-Roberts a participant replaces every lower ID
+		// with its own, not just the first one: the token holder or a dead
+		// peer may have swallowed our earlier candidacy.
+		p.participant = true
+		p.ringMu.Unlock()
+		p.sendCandidacy(gen)
+	}
+}
+
+// becomeLeader announces the result and mints the token of generation gen
+func (p *Peer) becomeLeader(gen uint64) {
+	p.ringMu.Lock()
+	if !p.participant || p.electionGen != gen {
+		// Already won through the other direction
+		p.ringMu.Unlock()
+		return
+	}
+	p.participant = false
+	p.leader = p.ID
+	p.ringMu.Unlock()
+
+	log.Printf("Elected leader for generation %d, injecting the token", gen)
+	if err := p.sendToSuccessor(fmt.Sprintf("LEADER %d %s", gen, p.ID)); err != nil {
+		log.Printf("Failed to announce leadership: %v", err)
+	}
+	go p.handleToken(newToken(gen, p.ID))
+}
+
+// handleLeader records the elected leader and passes the announcement on
+func (p *Peer) handleLeader(gen uint64, leader string) {
+	if leader == p.ID {
+		return
+	}
+	p.ringMu.Lock()
+	if gen >= p.electionGen {
+		p.resetElection(gen)
+		p.leader = leader
+		p.lastElection = time.Now()
+	}
+	p.ringMu.Unlock()
+
+	log.Printf("Peer %s is the leader for generation %d", leader, gen)
+	if err := p.sendToSuccessor(fmt.Sprintf("LEADER %d %s", gen, leader)); err != nil {
+		log.Printf("Failed to forward leader announcement: %v", err)
+	}
+}
+
+// sendProbes starts Hirschberg-Sinclair phase for this peer in both directions.
+// An unreachable neighbour ends the probe's range just like a reply would.
+func (p *Peer) sendProbes(gen uint64, phase int) {
+	var failed []string
+	for _, dir := range []string{clockwise, counterClockwise} {
+		if err := p.sendDirection(dir, fmt.Sprintf("PROBE %d %s %d 1 %s", gen, p.ID, phase, dir)); err != nil {
+			log.Printf("Failed to send %s probe: %v", dir, err)
+			failed = append(failed, dir)
+		}
+	}
+	if len(failed) == 2 {
+		log.Println("No neighbour reachable, giving up the election")
+		return
+	}
+	for _, dir := range failed {
+		p.handleReply(gen, p.ID, phase, dir)
+	}
+}
+
+// handleProbe relays probes of higher IDs up to 2^phase hops, then replies
+func (p *Peer) handleProbe(gen uint64, candidate string, phase, hops int, dir string) {
+	p.ringMu.Lock()
+	if !p.admitElection(gen) {
+		p.ringMu.Unlock()
+		return
+	}
+	startOwn := candidate < p.ID && !p.participant
+	if startOwn {
+		p.participant = true
+		p.electionStarted = time.Now()
+	}
+	p.ringMu.Unlock()
+
+	switch {
+	case candidate == p.ID:
+		// The probe travelled around the whole ring
+		p.becomeLeader(gen)
+	case candidate > p.ID && hops < 1<<phase:
+		msg := fmt.Sprintf("PROBE %d %s %d %d %s", gen, candidate, phase, hops+1, dir)
+		err := p.sendDirection(dir, msg)
+		if err == nil {
+			break
+		}
+		// The range ends at the unreachable neighbour
+		log.Printf("Failed to relay probe of %s: %v", candidate, err)
+		fallthrough
+	case candidate > p.ID:
+		back := opposite(dir)
+		if err := p.sendDirection(back, fmt.Sprintf("REPLY %d %s %d %s", gen, candidate, phase, back)); err != nil {
+			log.Printf("Failed to reply to probe of %s: %v", candidate, err)
+		}
+	case startOwn:
+		// A lower ID is swallowed; wake up as candidate ourselves
+		p.sendProbes(gen, 0)
+	}
+}
+
+// handleReply relays replies back to their candidate, who moves on to the next
+// phase once both directions have answered
+func (p *Peer) handleReply(gen uint64, candidate string, phase int, dir string) {
+	p.ringMu.Lock()
+	if !p.admitElection(gen) {
+		p.ringMu.Unlock()
+		return
+	}
+	if candidate != p.ID {
+		p.ringMu.Unlock()
+		if err := p.sendDirection(dir, fmt.Sprintf("REPLY %d %s %d %s", gen, candidate, phase, dir)); err != nil {
+			log.Printf("Failed to relay reply to %s: %v", candidate, err)
+		}
+		return
+	}
+	if !p.participant || phase != p.hsPhase {
+		p.ringMu.Unlock()
+		return
+	}
+	p.hsReplies++
+	next := p.hsReplies == 2
+	if next {
+		p.hsPhase++
+		p.hsReplies = 0
+	}
+	p.ringMu.Unlock()
+
+	if next {
+		p.sendProbes(gen, phase+1)
+	}
+}
+
+// handleHello records the peer that considers us its successor
+func (p *Peer) handleHello(predecessor string) {
+	p.ringMu.Lock()
+	p.predecessor = predecessor
+	p.ringMu.Unlock()
+}
+
+// announce tells the successor that we are its predecessor
+func (p *Peer) announce() {
+	if err := p.sendToSuccessor("HELLO " + p.ID); err != nil {
+		log.Printf("Failed to greet successor: %v", err)
+	}
+}
+
+// sendDirection sends msg to the successor (cw) or the predecessor (ccw)
+func (p *Peer) sendDirection(dir, msg string) error {
+	if dir == clockwise {
+		return p.sendToSuccessor(msg)
+	}
+	p.ringMu.Lock()
+	pred := p.predecessor
+	p.ringMu.Unlock()
+	return p.sendTo(pred, msg)
+}
+
+func opposite(dir string) string {
+	if dir == clockwise {
+		return counterClockwise
+	}
+	return clockwise
+}
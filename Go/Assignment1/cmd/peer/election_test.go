@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestHandleElectionMessageMalformedProbe(t *testing.T) {
+	// Rejected before they reach the peer, which has no ring to relay them on
+	p := &Peer{ID: "localhost:8081"}
+	for _, msg := range [][]string{
+		{"PROBE", "1", "localhost:8082", "-1", "1", clockwise},
+		{"PROBE", "1", "localhost:8082", "63", "1", clockwise},
+		{"PROBE", "1", "localhost:8082", "64", "1", counterClockwise},
+		{"PROBE", "1", "localhost:8082", "0", "0", clockwise},
+		{"PROBE", "1", "localhost:8082", "0", "-5", clockwise},
+		{"PROBE", "1", "localhost:8082", "x", "1", clockwise},
+		{"PROBE", "1", "localhost:8082", "0", "1"},
+	} {
+		if p.handleElectionMessage(msg) {
+			t.Errorf("handleElectionMessage(%q) = true, want the probe rejected", msg)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MutualExclusion is a distributed mutual exclusion algorithm serializing the
+// peers' access to the server, as an alternative to the token ring
+type MutualExclusion interface {
+	// Acquire blocks until this peer may enter the critical section
+	Acquire()
+	// Release leaves the critical section
+	Release()
+	// Handle processes a protocol message and reports whether it belonged to the algorithm
+	Handle(msg string) bool
+	// Messages returns the number of protocol messages sent so far
+	Messages() uint64
+}
+
+// NewMutualExclusion creates the algorithm called name for peer self among peers.
+// The first entry of peers starts with the token in the token based algorithms.
+func NewMutualExclusion(name, self string, peers []string, send func(addr, msg string) error) (MutualExclusion, error) {
+	if !slices.Contains(peers, self) {
+		return nil, fmt.Errorf("peer list does not contain %s", self)
+	}
+	base := meBase{
+		self:    self,
+		peers:   peers,
+		send:    send,
+		sent:    new(atomic.Uint64),
+		granted: make(chan struct{}, 1),
+	}
+	switch name {
+	case "ricart-agrawala":
+		return &RicartAgrawala{meBase: base}, nil
+	case "suzuki-kasami":
+		return NewSuzukiKasami(base), nil
+	case "raymond":
+		return NewRaymond(base), nil
+	}
+	return nil, fmt.Errorf("unknown mutual exclusion algorithm %q", name)
+}
+
+// meBase holds what every algorithm needs: the group, a transport and a way to
+// wake up the goroutine blocked in Acquire
+type meBase struct {
+	self    string
+	peers   []string
+	send    func(addr, msg string) error
+	sent    *atomic.Uint64
+	granted chan struct{}
+}
+
+// sendTo delivers a protocol message and counts it
+func (b *meBase) sendTo(addr, msg string) {
+	b.sent.Add(1)
+	if err := b.send(addr, msg); err != nil {
+		log.Printf("Failed to send %q to %s: %v", msg, addr, err)
+	}
+}
+
+// others returns every peer of the group except this one
+func (b *meBase) others() []string {
+	others := []string{}
+	for _, id := range b.peers {
+		if id != b.self {
+			others = append(others, id)
+		}
+	}
+	return others
+}
+
+func (b *meBase) grant() {
+	b.granted <- struct{}{}
+}
+
+func (b *meBase) Messages() uint64 {
+	return b.sent.Load()
+}
+
+// RicartAgrawala grants the critical section once every other peer has
+// replied to a request timestamped with a Lamport clock.
+// Messages: RA_REQUEST <ts> <id>, RA_REPLY <id>
+type RicartAgrawala struct {
+	meBase
+	mu         sync.Mutex
+	clock      int
+	requesting bool
+	requestTS  int
+	pending    int
+	deferred   []string
+}
+
+func (ra *RicartAgrawala) Acquire() {
+	ra.mu.Lock()
+	ra.clock++
+	ra.requesting = true
+	ra.requestTS = ra.clock
+	others := ra.others()
+	ra.pending = len(others)
+	for _, id := range others {
+		ra.sendTo(id, fmt.Sprintf("RA_REQUEST %d %s", ra.requestTS, ra.self))
+	}
+	if ra.pending == 0 {
+		ra.grant()
+	}
+	ra.mu.Unlock()
+	<-ra.granted
+}
+
+func (ra *RicartAgrawala) Release() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.requesting = false
+	for _, id := range ra.deferred {
+		ra.sendTo(id, "RA_REPLY "+ra.self)
+	}
+	ra.deferred = nil
+}
+
+func (ra *RicartAgrawala) Handle(msg string) bool {
+	fields := strings.Fields(msg)
+	switch {
+	case len(fields) == 3 && fields[0] == "RA_REQUEST":
+		ts, err := strconv.Atoi(fields[1])
+		if err != nil {
+			log.Printf("Invalid request timestamp: %s", msg)
+			return true
+		}
+		from := fields[2]
+
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		ra.clock = max(ra.clock, ts) + 1
+		// Ties on the timestamp are broken by peer ID
+		ours := ra.requesting && (ra.requestTS < ts || ra.requestTS == ts && ra.self < from)
+		if ours {
+			ra.deferred = append(ra.deferred, from)
+		} else {
+			ra.sendTo(from, "RA_REPLY "+ra.self)
+		}
+	case len(fields) == 2 && fields[0] == "RA_REPLY":
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		if ra.requesting && ra.pending > 0 {
+			ra.pending--
+			if ra.pending == 0 {
+				ra.grant()
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// skToken is the privilege passed around in Suzuki-Kasami
+type skToken struct {
+	LN    map[string]int // sequence number of the last request granted to each peer
+	Queue []string       // peers waiting for the token
+}
+
+// SuzukiKasami broadcasts requests and passes a single token carrying the
+// queue of outstanding requesters.
+// Messages: SK_REQUEST <id> <n>, SK_TOKEN <json>
+type SuzukiKasami struct {
+	meBase
+	mu    sync.Mutex
+	rn    map[string]int // highest request number received from each peer
+	token *skToken       // nil unless this peer holds the token
+	inCS  bool
+}
+
+func NewSuzukiKasami(base meBase) *SuzukiKasami {
+	sk := &SuzukiKasami{meBase: base, rn: make(map[string]int)}
+	if base.peers[0] == base.self {
+		sk.token = &skToken{LN: make(map[string]int)}
+	}
+	return sk
+}
+
+func (sk *SuzukiKasami) Acquire() {
+	sk.mu.Lock()
+	if sk.token != nil {
+		sk.inCS = true
+		sk.mu.Unlock()
+		return
+	}
+	sk.rn[sk.self]++
+	n := sk.rn[sk.self]
+	for _, id := range sk.others() {
+		sk.sendTo(id, fmt.Sprintf("SK_REQUEST %s %d", sk.self, n))
+	}
+	sk.mu.Unlock()
+	<-sk.granted
+}
+
+func (sk *SuzukiKasami) Release() {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	sk.inCS = false
+	sk.token.LN[sk.self] = sk.rn[sk.self]
+	for _, id := range sk.others() {
+		if sk.rn[id] == sk.token.LN[id]+1 && !slices.Contains(sk.token.Queue, id) {
+			sk.token.Queue = append(sk.token.Queue, id)
+		}
+	}
+	if len(sk.token.Queue) > 0 {
+		next := sk.token.Queue[0]
+		sk.token.Queue = sk.token.Queue[1:]
+		sk.passToken(next)
+	}
+}
+
+// passToken hands the token to another peer, called with mu held
+func (sk *SuzukiKasami) passToken(to string) {
+	data, err := json.Marshal(sk.token)
+	if err != nil {
+		log.Printf("Failed to encode token: %v", err)
+		return
+	}
+	sk.token = nil
+	sk.sendTo(to, "SK_TOKEN "+string(data))
+}
+
+func (sk *SuzukiKasami) Handle(msg string) bool {
+	fields := strings.Fields(msg)
+	switch {
+	case len(fields) == 3 && fields[0] == "SK_REQUEST":
+		from := fields[1]
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			log.Printf("Invalid request number: %s", msg)
+			return true
+		}
+
+		sk.mu.Lock()
+		defer sk.mu.Unlock()
+		sk.rn[from] = max(sk.rn[from], n)
+		if sk.token != nil && !sk.inCS && sk.rn[from] == sk.token.LN[from]+1 {
+			sk.passToken(from)
+		}
+	case len(fields) == 2 && fields[0] == "SK_TOKEN":
+		var tok skToken
+		if err := json.Unmarshal([]byte(fields[1]), &tok); err != nil {
+			log.Printf("Invalid token: %v", err)
+			return true
+		}
+		if tok.LN == nil {
+			tok.LN = make(map[string]int)
+		}
+
+		sk.mu.Lock()
+		defer sk.mu.Unlock()
+		sk.token = &tok
+		sk.inCS = true
+		sk.grant()
+	default:
+		return false
+	}
+	return true
+}
+
+// Raymond passes the privilege along a static spanning tree in which every
+// node points towards the current holder. The tree is the binary heap over
+// the peer list, rooted at its first entry.
+// Messages: RAY_REQUEST <id>, RAY_PRIVILEGE
+type Raymond struct {
+	meBase
+	mu     sync.Mutex
+	holder string   // neighbor in the direction of the privilege, or self
+	queue  []string // neighbors (or self) waiting for the privilege
+	using  bool
+	asked  bool
+}
+
+func NewRaymond(base meBase) *Raymond {
+	r := &Raymond{meBase: base, holder: base.self}
+	if i := slices.Index(base.peers, base.self); i > 0 {
+		r.holder = base.peers[(i-1)/2]
+	}
+	return r
+}
+
+func (r *Raymond) Acquire() {
+	r.mu.Lock()
+	r.queue = append(r.queue, r.self)
+	r.assignPrivilege()
+	r.makeRequest()
+	r.mu.Unlock()
+	<-r.granted
+}
+
+func (r *Raymond) Release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.using = false
+	r.assignPrivilege()
+	r.makeRequest()
+}
+
+// assignPrivilege serves the head of the queue if this node holds the privilege
+func (r *Raymond) assignPrivilege() {
+	if r.holder != r.self || r.using || len(r.queue) == 0 {
+		return
+	}
+	r.holder = r.queue[0]
+	r.queue = r.queue[1:]
+	r.asked = false
+	if r.holder == r.self {
+		r.using = true
+		r.grant()
+		return
+	}
+	r.sendTo(r.holder, "RAY_PRIVILEGE")
+}
+
+// makeRequest asks the holder direction for the privilege on behalf of the queue
+func (r *Raymond) makeRequest() {
+	if r.holder == r.self || len(r.queue) == 0 || r.asked {
+		return
+	}
+	r.asked = true
+	r.sendTo(r.holder, "RAY_REQUEST "+r.self)
+}
+
+func (r *Raymond) Handle(msg string) bool {
+	fields := strings.Fields(msg)
+	switch {
+	case len(fields) == 2 && fields[0] == "RAY_REQUEST":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.queue = append(r.queue, fields[1])
+		r.assignPrivilege()
+		r.makeRequest()
+	case len(fields) == 1 && fields[0] == "RAY_PRIVILEGE":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.holder = r.self
+		r.assignPrivilege()
+		r.makeRequest()
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/poisson"
+	"sd/Assignment1/protocol"
+	"sd/transport"
+)
+
+const (
+	tokenTimeout   = 30 * time.Second // silence after which the token is considered lost
+	maxDialBackoff = 10 * time.Second // upper bound between token forwarding retries
+	dialAttempts   = 3                // attempts per successor before bypassing it
+	maxTrail       = 64               // recent holders carried in the token, bounds the ring size for successor learning
+)
+
+type Peer struct {
+	ID         string
+	Host       string
+	Port       int
+	RemoteAddr string
+	Servers    *protocol.ServerList // the server, or every replica of a replicated one
+	localQueue []string
+	sending    int // requests taken out of localQueue by drainQueue
+	mu         sync.Mutex
+	k          int             // length of the successor list
+	mutex      MutualExclusion // replaces the token ring when set
+	audit      bool            // tag server requests for the server's audit mode
+	policy     HoldingPolicy
+	transport  *transport.Transport
+	pool       *ConnPool     // persistent connections to other peers and the server
+	json       bool          // talk to the server in its JSON protocol
+	requestID  atomic.Uint64 // ID of the last JSON request
+	keyPrefix  string        // unique to this run of the peer, see enqueue
+	keys       atomic.Uint64
+	draining   atomic.Bool   // set on shutdown: serve the whole queue regardless of the holding policy
+	quit       chan struct{} // closed once shut down, closes the listener
+
+	// Ring membership and token loss detection state, protected by ringMu.
+	// RemoteAddr is read and written through successor and setSuccessor.
+	ringMu      sync.Mutex
+	generation  uint64        // highest token generation seen
+	hops        uint64        // last hop number seen for generation
+	holding     bool          // true while this peer holds the token
+	lastToken   time.Time     // last time the token passed through this peer
+	successors  []string      // next peers after RemoteAddr's position, learned from the token trail
+	predecessor string        // peer whose successor we are, learned from HELLO and the token
+	leaving     bool          // true once a LEAVE has been announced
+	leaveAck    chan struct{} // closed when the predecessor confirms the LEAVE
+
+	// Leader election state, see election.go, protected by ringMu
+	electionAlgorithm string    // "cr" for Chang-Roberts, "hs" for Hirschberg-Sinclair
+	electionGen       uint64    // generation the current election will mint
+	participant       bool      // whether this peer is a candidate or relayed a higher one
+	sentOwn           bool      // whether our own ELECT went out in the current election
+	electionStarted   time.Time // when this peer last became a participant
+	lastElection      time.Time // last election message processed
+	leader            string
+	hsPhase           int // current Hirschberg-Sinclair phase
+	hsReplies         int // replies received in hsPhase
+}
+
+// HoldingPolicy limits how much of the local queue is served per visit to the
+// critical section, so one busy peer cannot starve the others
+type HoldingPolicy struct {
+	MaxBatch  int           // requests served per visit, 0 for no limit
+	MaxHold   time.Duration // time spent serving requests per visit, 0 for no limit
+	Priority  []string      // operations served first, in this order; others keep their queue order
+	HoldDelay time.Duration // simulated processing time before passing the ring token on
+}
+
+// order returns the queue sorted by priority class, keeping arrival order within a class
+func (hp HoldingPolicy) order(queue []string) []string {
+	class := func(request string) int {
+		_, request = protocol.CutRequestKey(request)
+		op, _, _ := strings.Cut(request, " ")
+		if i := slices.Index(hp.Priority, op); i >= 0 {
+			return i
+		}
+		return len(hp.Priority)
+	}
+	ordered := slices.Clone(queue)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return class(a) - class(b)
+	})
+	return ordered
+}
+
+// Token is the message circulating in the ring, sent as "TOKEN <json>"
+type Token struct {
+	HolderID   string   // peer currently holding the token
+	Timestamp  int64    // start of the current round, Unix nanoseconds
+	Generation uint64   // incremented each time a lost token is regenerated
+	Round      uint64   // rounds completed since the token was minted, plus one
+	Hops       uint64   // hops since the token was minted
+	Requests   int      // requests served during the current round
+	Origin     string   // peer at which rounds start and end
+	Trail      []string // most recent holders, oldest first
+}
+
+// newToken mints the first token of a generation, held by holder
+func newToken(gen uint64, holder string) Token {
+	return Token{
+		HolderID:   holder,
+		Timestamp:  time.Now().UnixNano(),
+		Generation: gen,
+		Round:      1,
+		Origin:     holder,
+	}
+}
+
+// validate checks that a received token is well formed
+func (t Token) validate() error {
+	switch {
+	case t.Generation == 0:
+		return errors.New("missing generation")
+	case t.HolderID == "" || t.Origin == "":
+		return errors.New("missing holder or origin")
+	case t.Round == 0:
+		return errors.New("missing round")
+	case t.Timestamp <= 0 || t.Timestamp > time.Now().Add(time.Minute).UnixNano():
+		return fmt.Errorf("invalid timestamp %d", t.Timestamp)
+	case t.Requests < 0:
+		return fmt.Errorf("invalid request count %d", t.Requests)
+	}
+	return nil
+}
+
+func NewPeer(host string, port int, remoteAddr, serverAddr string, k int, transport *transport.Transport) *Peer {
+	return &Peer{
+		ID:         fmt.Sprintf("%s:%d", host, port),
+		Host:       host,
+		Port:       port,
+		RemoteAddr: remoteAddr,
+		Servers:    protocol.NewServerList(serverAddr),
+		localQueue: []string{},
+		k:          k,
+		transport:  transport,
+		pool:       NewConnPool(transport.Dial),
+		keyPrefix:  fmt.Sprintf("%s-%x", host+":"+strconv.Itoa(port), time.Now().UnixNano()),
+		quit:       make(chan struct{}),
+		leaveAck:   make(chan struct{}),
+	}
+}
+
+// StartServer starts the peer's server to listen for incoming connections
+func (p *Peer) StartServer() {
+	addr := fmt.Sprintf("%s:%d", p.Host, p.Port)
+	listener, err := p.transport.Listen(addr)
+	if err != nil {
+		log.Fatalf("Failed to start server on %s: %v", addr, err)
+	}
+	defer listener.Close()
+	log.Printf("Peer server listening on %s...", addr)
+	go func() {
+		<-p.quit
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		go p.handleConnection(conn)
+	}
+}
+
+// handleConnection processes incoming tokens, regeneration claims and membership changes
+func (p *Peer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		msg := scanner.Text()
+		log.Printf("Received: %s", msg)
+
+		fields := strings.Fields(msg)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "TOKEN":
+			var tok Token
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(msg, "TOKEN ")), &tok); err != nil {
+				log.Printf("Invalid token message: %v", err)
+				fmt.Fprintf(conn, "NACK %v\n", err)
+				continue
+			}
+			if err := tok.validate(); err != nil {
+				log.Printf("Invalid token from %s: %v", tok.HolderID, err)
+				fmt.Fprintf(conn, "NACK %v\n", err)
+				continue
+			}
+			// Acknowledge before holding the token so the sender knows it was
+			// not written into a dead connection, and keep reading the stream
+			fmt.Fprintln(conn, "ACK")
+			go p.handleToken(tok)
+		case "HELLO":
+			if len(fields) != 2 {
+				log.Printf("Invalid greeting: %s", msg)
+				continue
+			}
+			p.handleHello(fields[1])
+		case "JOIN":
+			if len(fields) != 2 {
+				log.Printf("Invalid join request: %s", msg)
+				continue
+			}
+			p.handleJoin(conn, fields[1])
+		case "LEAVE":
+			if len(fields) != 3 {
+				log.Printf("Invalid leave notice: %s", msg)
+				continue
+			}
+			p.handleLeave(fields[1], fields[2])
+		case "EXCISE":
+			if len(fields) != 3 {
+				log.Printf("Invalid excise notice: %s", msg)
+				continue
+			}
+			p.handleExcise(fields[1], strings.Split(fields[2], ","))
+		case "LEFT":
+			p.ringMu.Lock()
+			if p.leaving {
+				select {
+				case <-p.leaveAck:
+				default:
+					close(p.leaveAck)
+				}
+			}
+			p.ringMu.Unlock()
+		default:
+			if p.handleElectionMessage(fields) {
+				continue
+			}
+			if p.mutex != nil && p.mutex.Handle(msg) {
+				continue
+			}
+			log.Printf("Unknown message: %s", msg)
+		}
+	}
+}
+
+// acceptToken records the arrival of a token and reports whether it is current.
+// Tokens from an older generation, or replays of a hop already seen, are stale.
+func (p *Peer) acceptToken(gen, hops uint64) bool {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+
+	if gen < p.generation || (gen == p.generation && hops <= p.hops) {
+		return false
+	}
+	p.generation = gen
+	p.hops = hops
+	p.holding = true
+	p.lastToken = time.Now()
+	if gen >= p.electionGen {
+		// Any election for this generation is over
+		p.resetElection(gen)
+	}
+	return true
+}
+
+// handleToken processes the token, sending requests to the server and forwarding it
+func (p *Peer) handleToken(tok Token) {
+	if !p.acceptToken(tok.Generation, tok.Hops) {
+		log.Printf("Discarding stale token from %s (generation %d, hop %d)", tok.HolderID, tok.Generation, tok.Hops)
+		return
+	}
+	p.learnSuccessors(tok.Trail)
+	if tok.HolderID != p.ID {
+		p.handleHello(tok.HolderID)
+	}
+
+	if tok.Origin == p.ID && tok.Hops > 0 {
+		latency := time.Since(time.Unix(0, tok.Timestamp))
+		log.Printf("Round %d completed in %v: %d requests served", tok.Round, latency.Round(time.Millisecond), tok.Requests)
+		tok.Round++
+		tok.Timestamp = time.Now().UnixNano()
+		tok.Requests = 0
+	}
+	log.Printf("Holding token from %s (generation %d, round %d, hop %d)", tok.HolderID, tok.Generation, tok.Round, tok.Hops)
+	tok.HolderID = p.ID
+	tok.Trail = append(tok.Trail, p.ID)
+	if len(tok.Trail) > maxTrail {
+		tok.Trail = tok.Trail[len(tok.Trail)-maxTrail:]
+	}
+
+	log.Println("Token received.")
+	served := p.drainQueue(tok.Round)
+	tok.Requests += served
+	log.Printf("Served %d of %d requests so far in round %d", served, tok.Requests, tok.Round)
+
+	// Forward the token
+	time.Sleep(p.policy.HoldDelay) // Simulate processing time
+	tok.Hops++
+	p.forwardToken(tok)
+}
+
+// drainQueue sends queued requests to the server as far as the holding policy
+// allows, keeping the rest for the next visit; it must only be called inside
+// the critical section, round identifies the visit for the server's audit.
+// It returns the number of requests the server answered.
+func (p *Peer) drainQueue(round uint64) int {
+	// The queue is taken out, so that enqueue is not held up by the server
+	p.mu.Lock()
+	policy := p.policy
+	if p.draining.Load() {
+		policy.MaxBatch, policy.MaxHold = 0, 0
+	}
+	queue := policy.order(p.localQueue)
+	p.localQueue = nil
+	p.sending = len(queue)
+	p.mu.Unlock()
+
+	log.Printf("Processing up to %d requests...", len(queue))
+	tag := ""
+	if p.audit {
+		tag = fmt.Sprintf("AUDIT %s %d ", p.ID, round)
+	}
+	start := time.Now()
+	sent := 0           // requests taken from the queue, answered or not
+	var failed []string // requests the server did not answer, kept for the next visit
+	if policy.MaxHold == 0 {
+		// Without a time limit the whole batch is pipelined in one round trip
+		sent = len(queue)
+		if policy.MaxBatch > 0 {
+			sent = min(sent, policy.MaxBatch)
+		}
+		batch := make([]string, 0, sent+1)
+		for _, request := range queue[:sent] {
+			batch = append(batch, requestLine(tag, request))
+		}
+		if p.audit && sent > 0 {
+			batch = append(batch, tag+"END")
+		}
+		if len(batch) > 0 {
+			unanswered := p.sendBatchToServer(batch)
+			for i, request := range queue[:sent] {
+				if slices.Contains(unanswered, batch[i]) {
+					failed = append(failed, request)
+				}
+			}
+		}
+	} else {
+		for _, request := range queue {
+			if policy.MaxBatch > 0 && sent == policy.MaxBatch {
+				break
+			}
+			if time.Since(start) >= policy.MaxHold {
+				break
+			}
+			sent++
+			if !p.sendMessageToServer(requestLine(tag, request)) {
+				failed = append(failed, request)
+				break
+			}
+		}
+		if p.audit && sent > 0 {
+			p.sendMessageToServer(tag + "END")
+		}
+	}
+	if len(failed) > 0 {
+		log.Printf("Server unavailable, %d requests kept for the next visit", len(failed))
+	}
+
+	// Requests queued meanwhile come after those left over
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.localQueue = append(append(failed, queue[sent:]...), p.localQueue...)
+	p.sending = 0
+	if len(p.localQueue) > 0 {
+		log.Printf("Holding policy reached, %d requests left for the next visit", len(p.localQueue))
+	}
+	return sent - len(failed)
+}
+
+// enqueue queues a request for the server. Each request gets a key that is
+// unique across runs of all peers, so that the server executes it only once
+// however often it is sent.
+func (p *Peer) enqueue(request string) {
+	key := fmt.Sprintf("%s-%d", p.keyPrefix, p.keys.Add(1))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.localQueue = append(p.localQueue, "REQUEST "+key+" "+request)
+}
+
+// requestLine tags a queued request for the server's audit, keeping its key
+// in front
+func requestLine(tag, request string) string {
+	key, command := protocol.CutRequestKey(request)
+	if key == "" {
+		return tag + command
+	}
+	return "REQUEST " + key + " " + tag + command
+}
+
+// runMutex enters the critical section through p.mutex whenever requests are
+// queued, and logs the waiting time and message cost of each entry.
+func (p *Peer) runMutex() {
+	var entries uint64
+	var waited time.Duration
+	for {
+		p.mu.Lock()
+		pending := len(p.localQueue)
+		p.mu.Unlock()
+		if pending == 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		start := time.Now()
+		p.mutex.Acquire()
+		wait := time.Since(start)
+		entries++
+		p.drainQueue(entries)
+		p.mutex.Release()
+
+		waited += wait
+		log.Printf("Critical section %d: waited %v (average %v), %.1f messages sent per entry",
+			entries, wait.Round(time.Millisecond), (waited / time.Duration(entries)).Round(time.Millisecond),
+			float64(p.mutex.Messages())/float64(entries))
+	}
+}
+
+// learnSuccessors extracts the peers that held the token after this peer's
+// previous visit; they are its next successors in ring order.
+func (p *Peer) learnSuccessors(trail []string) {
+	last := -1
+	for i, id := range trail {
+		if id == p.ID {
+			last = i
+		}
+	}
+	if last < 0 || last == len(trail)-1 {
+		return
+	}
+	succ := trail[last+1:]
+	if len(succ) > p.k {
+		succ = succ[:p.k]
+	}
+
+	p.ringMu.Lock()
+	p.successors = append([]string(nil), succ...)
+	p.ringMu.Unlock()
+}
+
+// successorCandidates returns RemoteAddr followed by the known successors
+// behind it, at most k entries, in the order they should be tried.
+func (p *Peer) successorCandidates() []string {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+
+	candidates := []string{p.RemoteAddr}
+	start := 0
+	for i, id := range p.successors {
+		if id == p.RemoteAddr {
+			start = i + 1
+			break
+		}
+	}
+	for _, id := range p.successors[start:] {
+		if len(candidates) == p.k {
+			break
+		}
+		if id != p.ID && id != p.RemoteAddr {
+			candidates = append(candidates, id)
+		}
+	}
+	return candidates
+}
+
+// forwardToken passes the token to the successor, retrying with backoff so a
+// restarting peer does not swallow it. When the successor stays unreachable the
+// next live peer of the successor list is used and the dead ones are excised
+// from the ring. The token is dropped only once a newer generation has been
+// minted elsewhere.
+func (p *Peer) forwardToken(tok Token) {
+	defer func() {
+		p.ringMu.Lock()
+		p.holding = false
+		p.lastToken = time.Now()
+		p.ringMu.Unlock()
+	}()
+
+	backoff := 500 * time.Millisecond
+	for {
+		candidates := p.successorCandidates()
+		for i, next := range candidates {
+			dead := candidates[:i]
+			out := tok
+			out.Trail = without(tok.Trail, dead)
+			if slices.Contains(dead, out.Origin) || p.isLeaving() && out.Origin == p.ID {
+				// Rounds would never complete again, let the next holder start them
+				out.Origin = next
+			}
+			data, err := json.Marshal(out)
+			if err != nil {
+				log.Printf("Failed to encode token: %v", err)
+				return
+			}
+			msg := "TOKEN " + string(data)
+			for attempt := 1; attempt <= dialAttempts; attempt++ {
+				err := p.sendToken(next, msg)
+				if errors.Is(err, errTokenRejected) {
+					log.Printf("Dropping token: %v", err)
+					return
+				}
+				if err == nil {
+					log.Printf("Token forwarded to %s", next)
+					if len(dead) > 0 {
+						p.bypass(dead, next)
+					}
+					return
+				}
+				log.Printf("Failed to forward token to %s: %v (retrying in %v)", next, err, backoff)
+				time.Sleep(backoff)
+				if p.superseded(tok.Generation) {
+					log.Printf("Dropping token of generation %d, a newer one exists", tok.Generation)
+					return
+				}
+				backoff = min(2*backoff, maxDialBackoff)
+			}
+		}
+	}
+}
+
+// errTokenRejected is returned when the successor refuses a malformed token
+var errTokenRejected = errors.New("token rejected")
+
+// sendToken delivers the token message and waits for the successor's acknowledgement
+func (p *Peer) sendToken(addr, msg string) error {
+	replies, err := p.pool.Get(addr).Call([]string{msg})
+	if err != nil {
+		return err
+	}
+	if reply := replies[0]; reply != "ACK" {
+		return fmt.Errorf("%w by %s: %s", errTokenRejected, addr, reply)
+	}
+	return nil
+}
+
+// isLeaving reports whether this peer has announced its departure
+func (p *Peer) isLeaving() bool {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+	return p.leaving
+}
+
+// superseded reports whether a token newer than generation gen has been seen
+func (p *Peer) superseded(gen uint64) bool {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+	return p.generation > gen
+}
+
+// bypass makes next the new successor after the peers in dead failed to
+// answer, and sends an EXCISE notice around the ring so everyone forgets them.
+func (p *Peer) bypass(dead []string, next string) {
+	p.ringMu.Lock()
+	p.RemoteAddr = next
+	p.successors = without(p.successors, dead)
+	p.ringMu.Unlock()
+
+	log.Printf("Bypassed unreachable peers %v, successor is now %s", dead, next)
+	if err := p.sendTo(next, fmt.Sprintf("EXCISE %s %s", p.ID, strings.Join(dead, ","))); err != nil {
+		log.Printf("Failed to send excise notice: %v", err)
+	}
+	p.announce()
+}
+
+// handleExcise removes crashed peers from the successor list and passes the
+// notice on until it is back at the peer that detected the crash.
+func (p *Peer) handleExcise(origin string, dead []string) {
+	if origin == p.ID {
+		return
+	}
+	p.ringMu.Lock()
+	p.successors = without(p.successors, dead)
+	p.ringMu.Unlock()
+
+	if err := p.sendToSuccessor(fmt.Sprintf("EXCISE %s %s", origin, strings.Join(dead, ","))); err != nil {
+		log.Printf("Failed to forward excise notice: %v", err)
+	}
+}
+
+// successor returns the address of the next peer in the ring
+func (p *Peer) successor() string {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+	return p.RemoteAddr
+}
+
+// setSuccessor atomically replaces the next peer in the ring and returns the old one
+func (p *Peer) setSuccessor(addr string) string {
+	p.ringMu.Lock()
+	defer p.ringMu.Unlock()
+	old := p.RemoteAddr
+	p.RemoteAddr = addr
+	return old
+}
+
+// sendTo delivers a single line to another peer
+func (p *Peer) sendTo(addr, msg string) error {
+	if addr == "" {
+		return errors.New("no successor known")
+	}
+	return p.pool.Get(addr).Send(msg)
+}
+
+// sendToSuccessor delivers a single line to the next peer in the ring,
+// bypassing successors that cannot be reached
+func (p *Peer) sendToSuccessor(msg string) error {
+	candidates := p.successorCandidates()
+	var err error
+	for i, next := range candidates {
+		if err = p.sendTo(next, msg); err == nil {
+			if i > 0 {
+				p.bypass(candidates[:i], next)
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// handleJoin splices a new peer between this peer and its current successor.
+// The joining peer learns its successor from the WELCOME reply.
+func (p *Peer) handleJoin(conn net.Conn, newcomer string) {
+	old := p.setSuccessor(newcomer)
+	log.Printf("Peer %s joined, successor changed from %s to %s", newcomer, old, newcomer)
+	fmt.Fprintf(conn, "WELCOME %s\n", old)
+}
+
+// handleLeave processes a LEAVE notice travelling around the ring. The
+// predecessor of the departing peer adopts its successor and acknowledges,
+// every other peer passes the notice on.
+func (p *Peer) handleLeave(departing, next string) {
+	if departing == p.ID {
+		// The notice went all the way around without finding a predecessor
+		return
+	}
+
+	p.ringMu.Lock()
+	p.successors = without(p.successors, []string{departing})
+	isPredecessor := p.RemoteAddr == departing
+	if isPredecessor {
+		p.RemoteAddr = next
+	}
+	p.ringMu.Unlock()
+
+	if !isPredecessor {
+		if err := p.sendToSuccessor(fmt.Sprintf("LEAVE %s %s", departing, next)); err != nil {
+			log.Printf("Failed to forward leave notice: %v", err)
+		}
+		return
+	}
+
+	log.Printf("Peer %s left, successor changed to %s", departing, next)
+	if err := p.sendTo(departing, "LEFT"); err != nil {
+		log.Printf("Failed to acknowledge leave of %s: %v", departing, err)
+	}
+	p.announce()
+}
+
+// Join enters an existing ring through contact, becoming its new successor
+func (p *Peer) Join(contact string) error {
+	conn, err := p.transport.Dial(contact)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "JOIN %s\n", p.ID)
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("connection closed before WELCOME")
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) != 2 || fields[0] != "WELCOME" {
+		return fmt.Errorf("unexpected reply to JOIN: %s", scanner.Text())
+	}
+	p.ringMu.Lock()
+	p.RemoteAddr = fields[1]
+	p.predecessor = contact
+	p.lastToken = time.Now() // The ring already has a token
+	p.ringMu.Unlock()
+	log.Printf("Joined ring through %s, successor is %s", contact, fields[1])
+	p.announce()
+	return nil
+}
+
+// Leave announces the departure of this peer and waits until its predecessor
+// has taken over the successor pointer and the token is no longer held here.
+func (p *Peer) Leave() {
+	p.ringMu.Lock()
+	p.leaving = true
+	next := p.RemoteAddr
+	p.ringMu.Unlock()
+
+	if next == p.ID {
+		log.Println("Last peer in the ring, leaving")
+		return
+	}
+	if err := p.sendTo(next, fmt.Sprintf("LEAVE %s %s", p.ID, next)); err != nil {
+		log.Printf("Failed to announce leave: %v", err)
+		return
+	}
+
+	select {
+	case <-p.leaveAck:
+		log.Println("Leave acknowledged by predecessor")
+	case <-time.After(tokenTimeout):
+		log.Println("Leave not acknowledged, leaving anyway")
+	}
+
+	// A token sent just before the predecessor switched may still arrive;
+	// keep serving it until it has been passed on, unless no successor answers.
+	time.Sleep(time.Second)
+	deadline := time.Now().Add(tokenTimeout)
+	for time.Now().Before(deadline) {
+		p.ringMu.Lock()
+		holding := p.holding
+		p.ringMu.Unlock()
+		if !holding {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Println("Token could not be passed on before leaving")
+}
+
+// Shutdown serves the requests still queued at the next visit to the critical
+// section, leaves the ring passing the token on, and finally closes the
+// listener and the connections
+func (p *Peer) Shutdown() {
+	p.draining.Store(true)
+	p.mu.Lock()
+	pending := len(p.localQueue) + p.sending
+	p.mu.Unlock()
+	if pending > 0 {
+		log.Printf("Serving %d queued requests before leaving...", pending)
+	}
+	deadline := time.Now().Add(tokenTimeout)
+	for pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		p.mu.Lock()
+		pending = len(p.localQueue) + p.sending
+		p.mu.Unlock()
+	}
+	if pending > 0 {
+		log.Printf("Critical section not reached in time, %d requests dropped", pending)
+	}
+
+	if p.mutex == nil {
+		p.Leave()
+	}
+	close(p.quit)
+	p.pool.Close()
+}
+
+// sendMessageToServer sends a request to the server and reports whether it
+// was answered
+func (p *Peer) sendMessageToServer(request string) bool {
+	return len(p.sendBatchToServer([]string{request})) == 0
+}
+
+// sendBatchToServer pipelines requests over the persistent server connection
+// and logs the responses. JSON responses are matched by ID, as the server's
+// pipelined protocol may answer them out of order. Requests left unanswered
+// because the server failed or is not the primary are sent again, to the
+// next replica if there are several, with exponential backoff. Requests the
+// server refused as busy are sent again to the same server once it asked to.
+// It returns the requests still unanswered after maxServerAttempts.
+func (p *Peer) sendBatchToServer(requests []string) []string {
+	backoff := minReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		addr := p.Servers.Primary()
+		unanswered, hint, err := p.callServer(addr, requests)
+		if len(unanswered) == 0 {
+			return nil
+		}
+		if attempt == maxServerAttempts {
+			log.Printf("Giving up on server after %d attempts, %d requests unanswered: %v", attempt, len(unanswered), err)
+			return unanswered
+		}
+		requests = unanswered
+		var busyErr serverBusyError
+		if errors.As(err, &busyErr) {
+			log.Printf("Server %s is busy, sending %d requests again in %v", addr, len(unanswered), time.Duration(busyErr))
+			time.Sleep(time.Duration(busyErr))
+			continue
+		}
+		next := p.Servers.Failover(addr, hint)
+		log.Printf("Server %s failed (%v), sending %d requests to %s in %v", addr, err, len(unanswered), next, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxReconnectBackoff)
+	}
+}
+
+// maxServerAttempts bounds how often a batch is sent before giving up
+const maxServerAttempts = 8
+
+// serverBusyError is returned by callServer when the server refused requests
+// as busy, asking to retry after the given time
+type serverBusyError time.Duration
+
+func (e serverBusyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %v", time.Duration(e))
+}
+
+// callServer sends requests to addr and returns those not answered, with the
+// primary named by a backup, if any
+func (p *Peer) callServer(addr string, requests []string) (unanswered []string, hint string, err error) {
+	lines := requests
+	pending := make(map[uint64]bool)
+	ids := make([]uint64, len(requests))
+	if p.json {
+		lines = make([]string, len(requests))
+		for i, request := range requests {
+			id := p.requestID.Add(1)
+			pending[id] = true
+			ids[i] = id
+			key, command := protocol.CutRequestKey(request)
+			data, _ := json.Marshal(protocol.Request{ID: id, Key: key, Command: command})
+			lines[i] = string(data)
+		}
+	}
+	for _, line := range lines {
+		log.Printf("Sent request to %s: %s", addr, line)
+	}
+	responses, err := p.pool.Get(addr).Call(lines)
+	refused := make([]bool, len(responses))
+	for i, response := range responses {
+		if primary, ok := protocol.NotPrimary(response); ok {
+			hint = primary
+			err = errors.New(protocol.NotPrimaryMessage)
+			refused[i] = true
+			continue
+		}
+		if retryAfter, ok := protocol.Busy(response); ok {
+			err = serverBusyError(retryAfter)
+			refused[i] = true
+			continue
+		}
+		if p.json {
+			logResponse(pending, response)
+		} else {
+			log.Printf("Received response from server: %s", response)
+		}
+	}
+	if !p.json {
+		// Text responses come in order, one per request
+		for i, request := range requests {
+			if i >= len(responses) || refused[i] {
+				unanswered = append(unanswered, request)
+			}
+		}
+		return unanswered, hint, err
+	}
+	for i, id := range ids {
+		if pending[id] {
+			unanswered = append(unanswered, requests[i])
+		}
+	}
+	return unanswered, hint, err
+}
+
+// logResponse logs a JSON protocol response and removes its ID from pending
+func logResponse(pending map[uint64]bool, line string) {
+	var resp protocol.Response
+	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+		log.Printf("Invalid response from server: %s", line)
+		return
+	}
+	if !pending[resp.ID] {
+		log.Printf("Unexpected response %d from server: %s", resp.ID, line)
+		return
+	}
+	delete(pending, resp.ID)
+	switch {
+	case resp.Error != nil:
+		log.Printf("Request %d failed: %s (%s)", resp.ID, resp.Error.Message, resp.Error.Code)
+	case resp.Value != "":
+		log.Printf("Result of request %d: %s (%s)", resp.ID, resp.Value, resp.Mode)
+	case resp.Result != nil:
+		log.Printf("Result of request %d: %g", resp.ID, *resp.Result)
+	default:
+		log.Printf("Response to request %d: %s", resp.ID, resp.Text)
+	}
+}
+
+func main() {
+	join := flag.Bool("join", false, "join a running ring through remoteAddr instead of using it as successor")
+	k := flag.Int("successors", 3, "number of successors to remember, up to k-1 consecutive crashes are bypassed")
+	algorithm := flag.String("mutex", "ring", "mutual exclusion algorithm: ring, ricart-agrawala, suzuki-kasami or raymond")
+	peers := flag.String("peers", "", "comma separated host:port of every peer, required unless -mutex=ring")
+	rate := flag.Float64("rate", 0.1, "requests generated per second")
+	audit := flag.Bool("audit", false, "tag requests with peer ID and round for a server running with -audit")
+	maxBatch := flag.Int("max-batch", 0, "maximum requests served per visit to the critical section, 0 for no limit")
+	maxHold := flag.Duration("max-hold", 0, "maximum time spent serving requests per visit, 0 for no limit")
+	priority := flag.String("priority", "", "comma separated operations served first, e.g. div,mul")
+	holdDelay := flag.Duration("hold-delay", 2*time.Second, "simulated processing time before the ring token is passed on")
+	election := flag.String("election", "cr", "ring leader election: cr (Chang-Roberts) or hs (Hirschberg-Sinclair)")
+	jsonProtocol := flag.Bool("json", false, "use the server's JSON protocol instead of plain text")
+	pipeline := flag.Bool("pipeline", false, "use the server's pipelined JSON protocol, answered out of order")
+	token := flag.String("token", "", "API token to authenticate to a server running with -auth")
+	var tlsFiles transport.TLSFiles
+	tlsFiles.AddFlags()
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 4 {
+		log.Fatalf("Usage: go run ./cmd/peer [flags] <host> <port> <remoteAddr> <serverAddr>[,<serverAddr>...]")
+	}
+	if len(args) > 4 {
+		log.Printf("Ignoring startToken argument, the token is injected by the elected leader")
+	}
+	if *k < 1 {
+		log.Fatalf("Invalid successor list length: %d", *k)
+	}
+	if *election != "cr" && *election != "hs" {
+		log.Fatalf("Unknown election algorithm %q", *election)
+	}
+
+	host := args[0]
+	port := atoi(args[1])
+	remoteAddr := args[2]
+	serverAddr := args[3]
+
+	// Peers only accept each other with a certificate signed by the CA
+	transport, err := transport.New(tlsFiles, tls.RequireAndVerifyClientCert)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	peer := NewPeer(host, port, remoteAddr, serverAddr, *k, transport)
+	peer.electionAlgorithm = *election
+	peer.audit = *audit
+	for _, addr := range peer.Servers.All() {
+		if *token != "" {
+			peer.pool.AddGreeting(addr, "AUTH "+*token, "OK ")
+		}
+		switch {
+		case *pipeline:
+			peer.json = true
+			peer.pool.AddGreeting(addr, "PROTOCOL pipeline", "OK pipeline")
+		case *jsonProtocol:
+			peer.json = true
+			peer.pool.AddGreeting(addr, "PROTOCOL json", "OK json")
+		}
+	}
+	peer.policy = HoldingPolicy{MaxBatch: *maxBatch, MaxHold: *maxHold, HoldDelay: *holdDelay}
+	if *priority != "" {
+		peer.policy.Priority = strings.Split(*priority, ",")
+		for _, name := range peer.policy.Priority {
+			if op := calculator.LookupOperation(name); op == nil || op.Syntax != calculator.Command {
+				log.Fatalf("Unknown operation %q in -priority", name)
+			}
+		}
+	}
+	if *algorithm != "ring" {
+		m, err := NewMutualExclusion(*algorithm, peer.ID, strings.Split(*peers, ","), peer.sendTo)
+		if err != nil {
+			log.Fatalf("Failed to set up %s: %v", *algorithm, err)
+		}
+		peer.mutex = m
+	}
+	if *join {
+		peer.RemoteAddr = ""
+	}
+	go peer.StartServer()
+
+	if peer.mutex != nil {
+		log.Printf("Using %s mutual exclusion", *algorithm)
+		go peer.runMutex()
+	} else if *join {
+		time.Sleep(time.Second) // Let the listener come up before the ring points at us
+		if err := peer.Join(remoteAddr); err != nil {
+			log.Fatalf("Failed to join ring through %s: %v", remoteAddr, err)
+		}
+		go peer.monitorToken()
+	} else {
+		go func() {
+			time.Sleep(2 * time.Second) // Wait for other peers to start
+			peer.announce()
+			time.Sleep(time.Second) // Let the predecessors become known
+			peer.startElection()
+			peer.monitorToken()
+		}()
+	}
+
+	// A second signal during the shutdown stops the peer right away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	pp := poisson.NewProcess(*rate, time.Now().UnixNano())
+	for ctx.Err() == nil {
+		peer.enqueue(calculator.RandomOperation())
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(pp.TimeForNextEvent() * float64(time.Second))):
+		}
+	}
+	stop()
+
+	log.Println("Shutting down...")
+	peer.Shutdown()
+	log.Println("Peer stopped")
+}
+
+// without returns ids minus every entry of drop
+func without(ids, drop []string) []string {
+	kept := []string{}
+	for _, id := range ids {
+		if !slices.Contains(drop, id) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// atoi converts a string to an integer
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Invalid number: %v", err)
+	}
+	return i
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+	replyTimeout        = 10 * time.Second // how long to wait for each reply line
+)
+
+// ConnPool keeps one long-lived connection per remote address
+type ConnPool struct {
+	mu        sync.Mutex
+	dial      func(addr string) (net.Conn, error)
+	conns     map[string]*PooledConn
+	greetings map[string][][2]string // by address: lines sent after dialing and the expected replies
+}
+
+// NewConnPool returns a pool connecting with dial
+func NewConnPool(dial func(addr string) (net.Conn, error)) *ConnPool {
+	return &ConnPool{dial: dial, conns: make(map[string]*PooledConn), greetings: make(map[string][][2]string)}
+}
+
+// AddGreeting makes every connection to addr start by sending greeting and
+// waiting for a reply starting with reply, e.g. to authenticate or negotiate
+// a protocol. Greetings are sent in the order they were added. It must be
+// called before addr is first used.
+func (cp *ConnPool) AddGreeting(addr, greeting, reply string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.greetings[addr] = append(cp.greetings[addr], [2]string{greeting, reply})
+}
+
+// Close closes every connection of the pool
+func (cp *ConnPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, pc := range cp.conns {
+		pc.mu.Lock()
+		pc.reset()
+		pc.mu.Unlock()
+	}
+}
+
+// Get returns the connection to addr, which is only dialed when first used
+func (cp *ConnPool) Get(addr string) *PooledConn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	pc, ok := cp.conns[addr]
+	if !ok {
+		pc = &PooledConn{addr: addr, dial: cp.dial, greetings: cp.greetings[addr]}
+		cp.conns[addr] = pc
+	}
+	return pc
+}
+
+// PooledConn is a line oriented connection that is re-established with
+// exponential backoff whenever it breaks. Lines sent over it arrive in order.
+type PooledConn struct {
+	addr      string
+	dial      func(addr string) (net.Conn, error)
+	mu        sync.Mutex
+	conn      net.Conn
+	reader    *bufio.Reader
+	backoff   time.Duration
+	nextDial  time.Time
+	connected bool // whether a connection was ever established, for logging
+
+	greetings [][2]string
+}
+
+// connect dials the remote if needed, waiting out the backoff of a previous
+// failure first. Called with mu held.
+func (pc *PooledConn) connect() error {
+	if pc.conn != nil {
+		if pc.alive() {
+			return nil
+		}
+		pc.reset()
+	}
+	if wait := time.Until(pc.nextDial); wait > 0 {
+		time.Sleep(wait)
+	}
+	conn, err := pc.dial(pc.addr)
+	if err != nil {
+		pc.backoff = min(max(2*pc.backoff, minReconnectBackoff), maxReconnectBackoff)
+		pc.nextDial = time.Now().Add(pc.backoff)
+		return err
+	}
+	pc.conn = conn
+	pc.reader = bufio.NewReader(conn)
+	if err := pc.greet(); err != nil {
+		pc.reset()
+		pc.backoff = min(max(2*pc.backoff, minReconnectBackoff), maxReconnectBackoff)
+		pc.nextDial = time.Now().Add(pc.backoff)
+		return err
+	}
+	if pc.connected {
+		log.Printf("Reconnected to %s", pc.addr)
+	}
+	pc.backoff = 0
+	pc.connected = true
+	return nil
+}
+
+// greet sends the greetings of a fresh connection, if any, and checks the
+// replies. Called with mu held.
+func (pc *PooledConn) greet() error {
+	if len(pc.greetings) == 0 {
+		return nil
+	}
+	pc.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	defer pc.conn.SetReadDeadline(time.Time{})
+	for _, g := range pc.greetings {
+		if _, err := fmt.Fprintf(pc.conn, "%s\n", g[0]); err != nil {
+			return err
+		}
+		reply, err := pc.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading greeting reply from %s: %w", pc.addr, err)
+		}
+		if reply = strings.TrimSpace(reply); !strings.HasPrefix(reply, g[1]) {
+			command, _, _ := strings.Cut(g[0], " ") // Not quoting tokens
+			return fmt.Errorf("%s answered %q to %s", pc.addr, reply, command)
+		}
+	}
+	return nil
+}
+
+// alive reports whether the remote end still has the connection open. A
+// write into a connection the remote already closed would succeed and be
+// lost silently, so the pending close is detected by peeking with a very
+// short deadline (an already expired one would not even try to read).
+// Called with mu held.
+func (pc *PooledConn) alive() bool {
+	pc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := pc.reader.Peek(1)
+	pc.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return err == nil || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reset drops a broken connection so the next use dials again. Called with mu held.
+func (pc *PooledConn) reset() {
+	if pc.conn != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		pc.reader = nil
+	}
+}
+
+// Send writes a single line, reconnecting once if the cached connection is broken
+func (pc *PooledConn) Send(line string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = pc.connect(); err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(pc.conn, "%s\n", line); err == nil {
+			return nil
+		}
+		pc.reset()
+	}
+	return err
+}
+
+// Call pipelines lines and then reads one reply line per request. Blank lines
+// between replies are skipped. On failure the replies read so far are
+// returned together with the error, and the connection is reset.
+func (pc *PooledConn) Call(lines []string) ([]string, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if err := pc.connect(); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if _, err := pc.conn.Write([]byte(b.String())); err != nil {
+		pc.reset()
+		return nil, err
+	}
+
+	replies := make([]string, 0, len(lines))
+	for len(replies) < len(lines) {
+		pc.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+		reply, err := pc.reader.ReadString('\n')
+		if err != nil {
+			pc.reset()
+			return replies, fmt.Errorf("reading reply from %s: %w", pc.addr, err)
+		}
+		if reply = strings.TrimSpace(reply); reply != "" {
+			replies = append(replies, reply)
+		}
+	}
+	pc.conn.SetReadDeadline(time.Time{})
+	return replies, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// auditIdle is how long an open critical section may stay silent before it is
+// considered abandoned by a crashed holder
+const auditIdle = time.Minute
+
+// csInterval is one visit of a peer to the critical section as seen by the server
+type csInterval struct {
+	Holder   string
+	Round    uint64
+	Start    time.Time
+	Last     time.Time
+	Requests int
+}
+
+// violation records two holders found in the critical section at the same time
+type violation struct {
+	First, Second csInterval
+	At            time.Time
+}
+
+// Auditor checks that tagged requests from different peers never interleave,
+// i.e. that the peers' mutual exclusion really holds
+type Auditor struct {
+	mu         sync.Mutex
+	open       map[string]*csInterval // by holder
+	closed     int
+	requests   int
+	violations []violation
+}
+
+func NewAuditor() *Auditor {
+	return &Auditor{open: make(map[string]*csInterval)}
+}
+
+// Enter records a request issued by holder during its critical section of the
+// given round and reports any other holder whose critical section is still open
+func (a *Auditor) Enter(holder string, round uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.requests++
+	cur, ok := a.open[holder]
+	if ok && cur.Round != round {
+		// The END of the previous round was lost
+		a.closeLocked(holder)
+		ok = false
+	}
+	if !ok {
+		cur = &csInterval{Holder: holder, Round: round, Start: now}
+		a.open[holder] = cur
+	}
+	cur.Last = now
+	cur.Requests++
+
+	for other, iv := range a.open {
+		if other == holder {
+			continue
+		}
+		if now.Sub(iv.Last) > auditIdle {
+			fmt.Printf("Audit: abandoning critical section of %s round %d, idle since %s\n",
+				iv.Holder, iv.Round, iv.Last.Format("15:04:05.000"))
+			a.closeLocked(other)
+			continue
+		}
+		v := violation{First: *iv, Second: *cur, At: now}
+		a.violations = append(a.violations, v)
+		fmt.Printf("Audit: VIOLATION %s round %d (open since %s) overlaps %s round %d\n",
+			iv.Holder, iv.Round, iv.Start.Format("15:04:05.000"), holder, round)
+	}
+}
+
+// Exit closes the critical section of holder for the given round
+func (a *Auditor) Exit(holder string, round uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if cur, ok := a.open[holder]; ok && cur.Round == round {
+		a.closeLocked(holder)
+	}
+}
+
+func (a *Auditor) closeLocked(holder string) {
+	delete(a.open, holder)
+	a.closed++
+}
+
+// Stats summarizes the audit on a single line
+func (a *Auditor) Stats() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := fmt.Sprintf("Audit: %d critical sections, %d open, %d requests, %d violations",
+		a.closed, len(a.open), a.requests, len(a.violations))
+	if n := len(a.violations); n > 0 {
+		last := a.violations[n-1]
+		stats += fmt.Sprintf("; last at %s: %s round %d overlapped %s round %d",
+			last.At.Format("15:04:05.000"), last.First.Holder, last.First.Round,
+			last.Second.Holder, last.Second.Round)
+	}
+	return stats
+}
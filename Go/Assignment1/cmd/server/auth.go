@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/protocol"
+)
+
+// With -auth the server only answers identified clients, and only with the
+// operations their identity allows. A client identifies itself by sending
+//
+//	AUTH <token>
+//
+// answered with "OK <name>", or by a TLS client certificate whose common
+// name is the cert of an identity. The identities are read from a JSON file:
+//
+//	{"identities": [
+//	  {"name": "team-a", "token": "7f3c...", "allow": ["add", "sub", "eval", "session"]},
+//	  {"name": "ring", "token": "91ab...", "allow": ["add", "sub", "mul", "div", "audit"]},
+//	  {"name": "replica", "cert": "replica", "allow": ["replicate"]}
+//	]}
+//
+// The operations an identity may be allowed are:
+//
+//	add, sub, mul, div  the legacy commands, and other registered commands
+//	eval                expressions
+//	let                 storing variables, also needs the operation stored
+//	session             history and mode
+//	audit               AUDIT and STATS, AUDIT also needs the operation tagged
+//	replicate           REPLICATE, for backup replicas
+//	*                   all of them
+//
+// AUTH, PROTOCOL and ROLE are answered without authentication, SESSION to
+// every identity: session IDs are random and only known to their client.
+
+// Identity is a client known to the server
+type Identity struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token,omitempty"`
+	Cert  string   `json:"cert,omitempty"` // common name of the client certificate
+	Allow []string `json:"allow"`
+}
+
+// Authenticator holds the identities the server accepts
+type Authenticator struct {
+	Identities []Identity `json:"identities"`
+}
+
+// LoadAuthenticator reads the identities from the JSON file at path
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, id := range a.Identities {
+		if id.Name == "" || id.Token == "" && id.Cert == "" {
+			return nil, fmt.Errorf("identity %q needs a name and a token or cert", id.Name)
+		}
+	}
+	return a, nil
+}
+
+// ByToken returns the identity with the given token, or nil
+func (a *Authenticator) ByToken(token string) *Identity {
+	var found *Identity
+	// Every token is compared, in constant time, not to leak which one matched
+	for i := range a.Identities {
+		id := &a.Identities[i]
+		if id.Token != "" && subtle.ConstantTimeCompare([]byte(id.Token), []byte(token)) == 1 {
+			found = id
+		}
+	}
+	return found
+}
+
+// ByCert returns the identity of a client certificate's common name, or nil
+func (a *Authenticator) ByCert(commonName string) *Identity {
+	for i := range a.Identities {
+		if id := &a.Identities[i]; id.Cert != "" && id.Cert == commonName {
+			return id
+		}
+	}
+	return nil
+}
+
+// Authorize returns an authError unless id may run command
+func (a *Authenticator) Authorize(id *Identity, command string) error {
+	if id == nil {
+		return errUnauthenticated
+	}
+	for _, op := range requiredOperations(command) {
+		if !slices.Contains(id.Allow, op) && !slices.Contains(id.Allow, "*") {
+			return &authError{protocol.CodeForbidden, fmt.Sprintf("%s is not allowed to use %s", id.Name, op)}
+		}
+	}
+	return nil
+}
+
+// requiredOperations lists the operations command needs to be allowed
+func requiredOperations(command string) []string {
+	fields := strings.Fields(command)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "AUDIT":
+		if len(fields) < 4 || fields[3] == "END" {
+			return []string{"audit"}
+		}
+		return append([]string{"audit"}, requiredOperations(strings.Join(fields[3:], " "))...)
+	case "STATS":
+		return []string{"audit"}
+	case "SESSION":
+		return nil
+	case "history", "mode":
+		return []string{"session"}
+	case "REPLICATE":
+		return []string{"replicate"}
+	case "let":
+		_, rhs, _ := cutLet(strings.Join(fields, " "))
+		return append([]string{"let"}, requiredOperations(rhs)...)
+	}
+	if op := calculator.LookupOperation(fields[0]); op != nil && op.Syntax == calculator.Command && len(fields) == 1+op.Arity {
+		return []string{op.Name}
+	}
+	return []string{"eval"}
+}
+
+// ownerName is the name of the identity sessions are owned by, empty for
+// clients that did not authenticate
+func ownerName(identity *Identity) string {
+	if identity == nil {
+		return ""
+	}
+	return identity.Name
+}
+
+// errSessionOwner refuses to resume the session of another identity
+var errSessionOwner = &authError{protocol.CodeForbidden, "the session belongs to another identity"}
+
+// authError refuses a request of a client that is not authenticated or not
+// allowed to make it
+type authError struct {
+	code string
+	msg  string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+func (e *authError) Code() string {
+	return e.code
+}
+
+var (
+	errUnauthenticated = &authError{protocol.CodeUnauthenticated, "authentication required, send AUTH <token>"}
+	errInvalidToken    = &authError{protocol.CodeUnauthenticated, "invalid token"}
+)
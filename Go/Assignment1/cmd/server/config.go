@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ServerConfig holds the server's settings. They are read from the JSON file
+// given with -config, e.g.
+//
+//	{"listen": ":9090", "max_conns": 100, "idle_timeout": "2m", "read_timeout": "10s"}
+//
+// and flags given on the command line take precedence over the file.
+type ServerConfig struct {
+	Listen        string   `json:"listen"`          // address to listen on
+	MaxConns      int      `json:"max_conns"`       // concurrent connections, 0 for no limit
+	IdleTimeout   Duration `json:"idle_timeout"`    // how long a connection may wait between requests
+	ReadTimeout   Duration `json:"read_timeout"`    // how long receiving the rest of a started request may take
+	WriteTimeout  Duration `json:"write_timeout"`   // how long a client may take to accept a response
+	MaxLineLength int      `json:"max_line_length"` // longest request line in bytes
+	Workers       int      `json:"workers"`         // workers evaluating pipelined requests
+	Audit         bool     `json:"audit"`
+	DedupTTL      Duration `json:"dedup_ttl"`     // how long replies are kept for retried requests
+	Replicas      []string `json:"replicas"`      // every replica of a replicated server
+	Advertise     string   `json:"advertise"`     // this server's entry in Replicas
+	RateLimit     float64  `json:"rate_limit"`    // commands per second per client, 0 for no limit
+	RateBurst     int      `json:"rate_burst"`    // commands at once above RateLimit, 0 for one second's worth
+	MaxInflight   int      `json:"max_inflight"`  // commands evaluated at once, 0 for no limit
+	AuthFile      string   `json:"auth_file"`     // identities of the clients, see auth.go
+	ReplicaToken  string   `json:"replica_token"` // token the replicas authenticate with to each other
+	TLSCert       string   `json:"tls_cert"`      // certificate of the server, enables TLS
+	TLSKey        string   `json:"tls_key"`
+	ClientCA      string   `json:"client_ca"`   // CA of the client certificates
+	TLSCA         string   `json:"tls_ca"`      // CA of the other replicas' certificates
+	HTTPListen    string   `json:"http_listen"` // address of the HTTP gateway, see gateway.go
+}
+
+// config is the configuration the server runs with
+var config = ServerConfig{
+	Listen:        ":8080",
+	IdleTimeout:   Duration{5 * time.Minute},
+	ReadTimeout:   Duration{30 * time.Second},
+	WriteTimeout:  Duration{30 * time.Second},
+	MaxLineLength: 64 * 1024,
+	Workers:       8,
+	DedupTTL:      Duration{10 * time.Minute},
+}
+
+// Duration is a time.Duration written as a string such as "90s" in JSON
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// loadConfig reads the settings present in the JSON file at path into cfg
+func loadConfig(path string, cfg *ServerConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate rejects settings the server cannot run with
+func (c ServerConfig) validate() error {
+	switch {
+	case c.MaxConns < 0 || c.MaxInflight < 0:
+		return fmt.Errorf("max_conns and max_inflight must not be negative")
+	case c.RateLimit < 0 || c.RateBurst < 0:
+		return fmt.Errorf("rate_limit and rate_burst must not be negative")
+	case c.IdleTimeout.Duration <= 0 || c.ReadTimeout.Duration <= 0 || c.WriteTimeout.Duration <= 0 || c.DedupTTL.Duration <= 0:
+		return fmt.Errorf("timeouts must be positive")
+	case c.MaxLineLength < 16:
+		return fmt.Errorf("max_line_length must be at least 16 bytes")
+	case c.Workers < 1:
+		return fmt.Errorf("at least one worker is needed")
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return fmt.Errorf("tls_cert and tls_key must be given together")
+	case c.ClientCA != "" && c.TLSCert == "":
+		return fmt.Errorf("client_ca needs tls_cert")
+	}
+	return nil
+}
+
+// advertisedAddr is the address other servers reach a server listening on
+// listen at, by default with localhost as host
+func advertisedAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || host != "" && host != "0.0.0.0" && host != "::" {
+		return listen
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// timedReader sets the read deadline of conn before every read: a client
+// waiting between requests gets the idle timeout, one in the middle of a
+// request the read timeout. Once closing is closed every read fails at once.
+type timedReader struct {
+	conn       net.Conn
+	idle, read time.Duration
+	closing    <-chan struct{}
+	midRequest bool
+	timedOut   bool // a read failed on the deadline
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	timeout := r.idle
+	if r.midRequest {
+		timeout = r.read
+	}
+	r.conn.SetReadDeadline(time.Now().Add(timeout))
+	// Checked after setting the deadline, so a concurrent shutdown always wins
+	select {
+	case <-r.closing:
+		r.conn.SetReadDeadline(time.Now())
+	default:
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.midRequest = p[n-1] != '\n'
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		r.timedOut = true
+	}
+	return n, err
+}
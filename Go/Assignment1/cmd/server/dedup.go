@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/protocol"
+)
+
+// DedupTable remembers the replies to requests carrying a key, so that a
+// client retrying a request, e.g. after reconnecting to another replica, gets
+// the reply of the first execution instead of running the command again.
+// Replies are forgotten ttl after they were sent.
+type DedupTable struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	ttl     time.Duration
+}
+
+type dedupEntry struct {
+	done     chan struct{} // closed once the reply is final
+	reply    Reply
+	executed bool // whether reply is set
+	at       time.Time
+}
+
+func NewDedupTable(ttl time.Duration) *DedupTable {
+	d := &DedupTable{entries: make(map[string]*dedupEntry), ttl: ttl}
+	go d.expire()
+	return d
+}
+
+// Claim returns the entry of key, and whether the caller is the first to see
+// the key and so has to execute the request and Complete it
+func (d *DedupTable) Claim(key string) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+// Executed records the reply of a claimed key before it is final, e.g. while
+// it is being replicated
+func (d *DedupTable) Executed(key string, reply Reply) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries[key]; ok {
+		e.reply, e.executed = reply, true
+	}
+}
+
+// Complete makes the reply of a claimed key final and wakes up its retries
+func (d *DedupTable) Complete(key string, reply Reply) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[key]
+	if !ok {
+		return
+	}
+	e.reply, e.executed, e.at = reply, true, time.Now()
+	close(e.done)
+}
+
+// Store records the final reply of a request executed by another server
+func (d *DedupTable) Store(key string, reply Reply) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := &dedupEntry{done: make(chan struct{}), reply: reply, executed: true, at: time.Now()}
+	close(e.done)
+	d.entries[key] = e
+}
+
+// expire forgets the final replies older than the TTL
+func (d *DedupTable) expire() {
+	for range time.Tick(d.ttl / 10) {
+		d.mu.Lock()
+		for key, e := range d.entries {
+			select {
+			case <-e.done:
+				if time.Since(e.at) > d.ttl {
+					delete(d.entries, key)
+				}
+			default:
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// dedupState is a remembered reply as transferred between servers
+type dedupState struct {
+	Key    string                  `json:"key"`
+	Result string                  `json:"result,omitempty"` // strconv formatted, JSON numbers cannot be infinite
+	Value  string                  `json:"value,omitempty"`
+	Mode   string                  `json:"mode,omitempty"`
+	Text   string                  `json:"text,omitempty"`
+	Error  *protocol.ResponseError `json:"error,omitempty"`
+	Usage  bool                    `json:"usage,omitempty"` // Error is a usage error
+}
+
+// States returns every executed request's reply
+func (d *DedupTable) States() []dedupState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	states := make([]dedupState, 0, len(d.entries))
+	for key, e := range d.entries {
+		if !e.executed {
+			continue
+		}
+		st := dedupState{Key: key, Value: e.reply.Value, Mode: e.reply.Mode, Text: e.reply.Text}
+		if e.reply.Result != nil {
+			st.Result = strconv.FormatFloat(*e.reply.Result, 'g', -1, 64)
+		}
+		if e.reply.Err != nil {
+			resp := e.reply.Response(0)
+			st.Error = resp.Error
+			_, st.Usage = e.reply.Err.(calculator.UsageError)
+		}
+		states = append(states, st)
+	}
+	return states
+}
+
+// Replace swaps all entries for the replies of states
+func (d *DedupTable) Replace(states []dedupState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = make(map[string]*dedupEntry, len(states))
+	for _, st := range states {
+		reply := Reply{Value: st.Value, Mode: st.Mode, Text: st.Text}
+		if f, err := strconv.ParseFloat(st.Result, 64); err == nil {
+			reply.Result = &f
+		}
+		switch {
+		case st.Error == nil:
+		case st.Usage:
+			reply.Err = calculator.UsageError(st.Error.Message)
+		default:
+			reply.Err = calculator.Errorf(st.Error.Code, "%s", st.Error.Message)
+		}
+		e := &dedupEntry{done: make(chan struct{}), reply: reply, executed: true, at: time.Now()}
+		close(e.done)
+		d.entries[st.Key] = e
+	}
+}
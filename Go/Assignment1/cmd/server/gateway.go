@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/protocol"
+	"sd/transport"
+)
+
+// The HTTP gateway, started with -http, answers the same requests as the
+// JSON protocol over HTTP:
+//
+//	POST /eval   {"command": "let a = 1/3", "mode": "rat"}
+//	          -> {"id": 0, "result": 0.3333333333333333, "value": "1/3", "mode": "rat"}
+//	POST /batch  {"requests": [{"id": 1, "command": "let a = 2"}, {"id": 2, "command": "a ^ 10"}]}
+//	          -> {"responses": [{"id": 1, "result": 2, "mode": "float"}, {"id": 2, "result": 1024, "mode": "float"}]}
+//
+// The requests of a batch run in order in one session, which is dropped
+// afterwards unless the body names an existing session of the same identity
+// with "session"; so does /eval. Clients authenticate with an "Authorization: Bearer <token>"
+// header or a TLS client certificate, and every command counts against the
+// same limits as on the TCP port. A request refused before it is evaluated
+// gets the status of its error code: 401 unauthenticated, 403 forbidden,
+// 429 busy with Retry-After, 503 not_primary, 400 invalid_request and 404
+// unknown_session. A command that fails to evaluate, e.g. with
+// division_by_zero, is still answered with 200 and the error in the body.
+
+// maxBatchBody bounds the body of a /batch request in bytes
+const maxBatchBody = 1 << 20
+
+// errBearerRequired replaces errUnauthenticated, whose AUTH command is not
+// available over HTTP
+var errBearerRequired = &authError{protocol.CodeUnauthenticated, "authentication required, send an Authorization: Bearer <token> header"}
+
+// evalRequest is the body of POST /eval
+type evalRequest struct {
+	protocol.Request
+	Session string `json:"session,omitempty"` // existing session to run in
+}
+
+// batchRequest is the body of POST /batch
+type batchRequest struct {
+	Session  string             `json:"session,omitempty"`
+	Requests []protocol.Request `json:"requests"`
+}
+
+// batchResponse answers a batchRequest, with a response per request in the
+// same order
+type batchResponse struct {
+	Responses []protocol.Response `json:"responses"`
+}
+
+// startGateway serves the HTTP gateway on addr until the returned server is
+// shut down
+func startGateway(transport *transport.Transport, addr string) (*http.Server, error) {
+	listener, err := transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Method patterns need Go 1.22, which ../go.mod requires
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /eval", handleEval)
+	mux.HandleFunc("POST /batch", handleBatch)
+	srv := &http.Server{
+		Handler:     mux,
+		ReadTimeout: config.ReadTimeout.Duration,
+		IdleTimeout: config.IdleTimeout.Duration,
+	}
+	go func() {
+		if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("HTTP gateway failed:", err)
+		}
+	}()
+	fmt.Printf("HTTP gateway is listening on %s\n", listener.Addr())
+	return srv, nil
+}
+
+// stopGateway waits for the requests in flight, closing what is left after
+// shutdownTimeout
+func stopGateway(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if srv.Shutdown(ctx) != nil {
+		srv.Close()
+	}
+}
+
+func handleEval(w http.ResponseWriter, r *http.Request) {
+	identity, err := gatewayIdentity(r)
+	if err != nil {
+		writeResponse(w, Reply{Err: err}.Response(0))
+		return
+	}
+	var req evalRequest
+	if !decodeBody(w, r, &req, int64(config.MaxLineLength)) {
+		return
+	}
+	session, done, err := gatewaySession(identity, req.Session)
+	if err != nil {
+		writeResponse(w, Reply{Err: err}.Response(req.ID))
+		return
+	}
+	defer done()
+	writeResponse(w, gatewayExecute(r, identity, session, req.Request))
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	identity, err := gatewayIdentity(r)
+	if err != nil {
+		writeResponse(w, Reply{Err: err}.Response(0))
+		return
+	}
+	var batch batchRequest
+	if !decodeBody(w, r, &batch, maxBatchBody) {
+		return
+	}
+	session, done, err := gatewaySession(identity, batch.Session)
+	if err != nil {
+		writeResponse(w, Reply{Err: err}.Response(0))
+		return
+	}
+	defer done()
+	resp := batchResponse{Responses: make([]protocol.Response, len(batch.Requests))}
+	for i, req := range batch.Requests {
+		resp.Responses[i] = gatewayExecute(r, identity, session, req)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// gatewayIdentity returns the identity of the bearer token or the TLS client
+// certificate of r, nil if it has neither, and an error for an unknown token
+func gatewayIdentity(r *http.Request) (*Identity, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if id := auth.ByToken(token); id != nil {
+			return id, nil
+		}
+		return nil, errInvalidToken
+	}
+	if r.TLS != nil {
+		if cn := transport.PeerCommonName(*r.TLS); cn != "" {
+			return auth.ByCert(cn), nil
+		}
+	}
+	return nil, nil
+}
+
+// gatewaySession returns the session named id if it belongs to identity, or a
+// new one of identity if id is empty.
+// done drops the new session once the request is answered.
+func gatewaySession(identity *Identity, id string) (session *Session, done func(), err error) {
+	if id == "" {
+		session = sessions.Create(ownerName(identity))
+		return session, func() {
+			// A backup refused the commands and leaves its log to the primary
+			if replica != nil && replica.serving() != nil {
+				sessions.Remove(session.ID)
+				return
+			}
+			dropSession(session.ID)
+		}, nil
+	}
+	if session = sessions.Get(id); session == nil {
+		return nil, nil, calculator.Errorf(protocol.CodeUnknownSession, "unknown session %q", id)
+	}
+	if session.Owner() != ownerName(identity) {
+		return nil, nil, errSessionOwner
+	}
+	return session, func() {}, nil
+}
+
+// gatewayExecute runs a request of the gateway in session, after the same
+// checks as handleConnection makes
+func gatewayExecute(r *http.Request, identity *Identity, session *Session, req protocol.Request) protocol.Response {
+	fields := strings.Fields(req.Command)
+	logCommand(identity, req.Command, fields)
+	release, err := limits.Admit(limitKey(r.RemoteAddr, identity))
+	if err != nil {
+		return Reply{Err: err}.Response(req.ID)
+	}
+	defer release()
+	if err := admit(identity, req.Command); err != nil {
+		if err == errUnauthenticated {
+			err = errBearerRequired
+		}
+		return Reply{Err: err}.Response(req.ID)
+	}
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "AUTH", "PROTOCOL", "SESSION", "REPLICATE":
+			return Reply{Err: calculator.UsageError(fields[0] + " is not available over HTTP")}.Response(req.ID)
+		}
+	}
+	key := req.Key
+	if key != "" && identity != nil {
+		key = identity.Name + "/" + key
+	}
+	return executeOnce(session, key, req.Command, req.Mode).Response(req.ID)
+}
+
+// decodeBody reads the JSON body of r into v, answering invalid ones with
+// 400 Bad Request
+func decodeBody(w http.ResponseWriter, r *http.Request, v any, limit int64) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if err := dec.Decode(v); err != nil {
+		writeResponse(w, protocol.Response{Error: &protocol.ResponseError{Code: protocol.CodeInvalidRequest, Message: err.Error()}})
+		return false
+	}
+	return true
+}
+
+// writeResponse writes resp with the status of its error code
+func writeResponse(w http.ResponseWriter, resp protocol.Response) {
+	status := http.StatusOK
+	if resp.Error != nil {
+		switch resp.Error.Code {
+		case protocol.CodeInvalidRequest:
+			status = http.StatusBadRequest
+		case protocol.CodeUnauthenticated:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			status = http.StatusUnauthorized
+		case protocol.CodeForbidden:
+			status = http.StatusForbidden
+		case protocol.CodeUnknownSession:
+			status = http.StatusNotFound
+		case protocol.CodeBusy:
+			// Retry-After is in whole seconds
+			w.Header().Set("Retry-After", strconv.FormatInt((resp.Error.RetryAfterMs+999)/1000, 10))
+			status = http.StatusTooManyRequests
+		case protocol.CodeNotPrimary:
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Printf("Failed to encode HTTP response: %v\n", err)
+	}
+}
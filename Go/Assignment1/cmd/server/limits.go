@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"sd/Assignment1/protocol"
+)
+
+// Admission control. Every client has a token bucket refilled at -rate-limit
+// tokens per second up to -rate-burst, and every command takes a token;
+// clients are told apart by their identity when they authenticated and by
+// their IP address otherwise. At most -max-inflight commands of all clients
+// are evaluated at once. A command over either limit is not evaluated but
+// answered with a busy error telling the client when to retry:
+//
+//	Error: busy, retry after 250ms
+//	{"id":7,"error":{"code":"busy","message":"busy, retry after 250ms","retry_after_ms":250}}
+
+// busyRetryAfter is the retry delay suggested when all inflight slots are taken
+const busyRetryAfter = 100 * time.Millisecond
+
+// bucketIdle is how long a full bucket is kept after its last use
+const bucketIdle = time.Minute
+
+// Limiter enforces the rate limits and the concurrency cap
+type Limiter struct {
+	rate  float64 // tokens per second, 0 for no limit
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	slots   chan struct{} // one per command being evaluated, nil for no cap
+}
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens  float64
+	at      time.Time // when tokens was last updated
+	limited bool      // whether the last command was refused, to log only the first
+}
+
+// NewLimiter allows rate commands per second per client with bursts of
+// burst, one second's worth if 0, and maxInflight commands at once. Zero
+// rate and maxInflight disable the limits.
+func NewLimiter(rate float64, burst, maxInflight int) *Limiter {
+	l := &Limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+	if burst == 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	if maxInflight > 0 {
+		l.slots = make(chan struct{}, maxInflight)
+	}
+	if rate > 0 {
+		go l.expire()
+	}
+	return l
+}
+
+// Admit takes an inflight slot and a token of client's bucket, or returns a
+// busyError if there is none. The slot is taken first so that a command
+// refused for the cap does not use up a token. release gives the slot back
+// once the command is answered.
+func (l *Limiter) Admit(client string) (release func(), err error) {
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		default:
+			return nil, &busyError{busyRetryAfter}
+		}
+	}
+	if wait := l.take(client); wait > 0 {
+		release()
+		return nil, &busyError{wait}
+	}
+	return release, nil
+}
+
+// take removes a token from client's bucket, or returns how long it takes
+// until there is one
+func (l *Limiter) take(client string) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return 0
+	}
+	if !b.limited {
+		fmt.Printf("Rate limiting %s to %g commands/s\n", client, l.rate)
+		b.limited = true
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// expire forgets the buckets that have been full for a while
+func (l *Limiter) expire() {
+	for range time.Tick(bucketIdle) {
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			if time.Since(b.at) > bucketIdle+time.Duration(l.burst/l.rate*float64(time.Second)) {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limitKey is the name the limits of a client at remote address addr are
+// kept under
+func limitKey(addr string, identity *Identity) string {
+	if identity != nil {
+		return identity.Name
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// busyError refuses a command because the client or the server is over its
+// limit
+type busyError struct {
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%s, retry after %v", protocol.BusyMessage, e.RetryAfter())
+}
+
+func (e *busyError) Code() string {
+	return protocol.CodeBusy
+}
+
+// RetryAfter is how long the client should wait, in whole milliseconds
+func (e *busyError) RetryAfter() time.Duration {
+	return max((e.retryAfter + time.Millisecond - 1).Truncate(time.Millisecond), time.Millisecond)
+}
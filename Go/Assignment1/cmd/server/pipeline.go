@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"sd/Assignment1/protocol"
+)
+
+// job is a pipelined request waiting for a worker
+type job struct {
+	session *Session
+	id      uint64
+	key     string
+	command string
+	mode    string
+	done    func(protocol.Response)
+}
+
+// jobs feeds the bounded worker pool shared by all pipelined connections. A
+// connection blocks in reading further requests while the pool is saturated.
+var jobs chan job
+
+// startWorkers starts n workers evaluating pipelined requests
+func startWorkers(n int) {
+	jobs = make(chan job, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range jobs {
+				j.done(executeOnce(j.session, j.key, j.command, j.mode).Response(j.id))
+			}
+		}()
+	}
+}
+
+// isBarrier reports whether a pipelined command has to wait for the requests
+// sent before it and be answered before later ones start. These are the
+// commands that change, read or switch the session, close an audited critical section,
+// authenticate or switch the protocol.
+func isBarrier(command string) bool {
+	parts := strings.Fields(command)
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "@") {
+		parts = parts[1:]
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	switch parts[0] {
+	case "let", "history", "mode", "AUTH", "PROTOCOL", "SESSION":
+		return true
+	case "AUDIT":
+		return len(parts) == 4 && parts[3] == "END"
+	}
+	return false
+}
+
+// pipelineDepth bounds the pipelined requests of a connection being
+// evaluated or waiting for their response to be written; reading further
+// requests of the connection waits for one of them to be answered
+const pipelineDepth = 64
+
+// responseWriter serializes the responses of a connection. Workers do not
+// write pipelined responses themselves but queue them for the connection's
+// own writer, so that a client that does not read its responses only holds
+// up itself. A response it does not accept within the write timeout closes
+// the connection.
+type responseWriter struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	w      *bufio.Writer
+	failed bool
+	queue  chan queuedResponse // pipelined responses, written in the order they are done
+	slots  chan struct{}       // one per pipelined request not answered yet
+}
+
+type queuedResponse struct {
+	resp    protocol.Response
+	written func()
+}
+
+func newResponseWriter(conn net.Conn) *responseWriter {
+	rw := &responseWriter{
+		conn:  conn,
+		w:     bufio.NewWriter(conn),
+		queue: make(chan queuedResponse, pipelineDepth),
+		slots: make(chan struct{}, pipelineDepth),
+	}
+	go func() {
+		for q := range rw.queue {
+			rw.WriteJSON(q.resp)
+			<-rw.slots
+			q.written()
+		}
+	}()
+	return rw
+}
+
+// Reserve waits until another pipelined request may be evaluated
+func (rw *responseWriter) Reserve() {
+	rw.slots <- struct{}{}
+}
+
+// Queue hands the response of a reserved request to the writer, which calls
+// written once it is sent
+func (rw *responseWriter) Queue(resp protocol.Response, written func()) {
+	rw.queue <- queuedResponse{resp: resp, written: written}
+}
+
+// Close stops the writer once the queued responses are written
+func (rw *responseWriter) Close() {
+	close(rw.queue)
+}
+
+func (rw *responseWriter) WriteLine(line string) {
+	rw.write([]byte(line + "\n"))
+}
+
+func (rw *responseWriter) WriteJSON(resp protocol.Response) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(resp); err != nil {
+		fmt.Printf("Failed to encode response: %v\n", err)
+		return
+	}
+	rw.write(buf.Bytes())
+}
+
+// write sends a response right away. The deadline is lifted afterwards, as a
+// backup replica's connection is written by the replication itself.
+func (rw *responseWriter) write(data []byte) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.failed {
+		return
+	}
+	rw.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout.Duration))
+	rw.w.Write(data)
+	err := rw.w.Flush()
+	rw.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		rw.failed = true
+		fmt.Printf("Closing connection from %s: %v\n", rw.conn.RemoteAddr(), err)
+		rw.conn.Close()
+	}
+}
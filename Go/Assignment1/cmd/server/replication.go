@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sd/Assignment1/protocol"
+)
+
+// Primary-backup replication. Of the servers listed in -replicas one is the
+// primary and answers the clients; the others are backups that connect to it
+// with REPLICATE <addr>. The primary first sends a snapshot of all sessions
+// and then, in order, every command a session executes, and answers a
+// client only once every connected backup has acknowledged the command. It
+// sends a heartbeat when idle, which the backups acknowledge as well, so each
+// side notices within failureTimeout when the other one is gone.
+//
+// A backup that loses its primary asks the other replicas for their ROLE. If
+// one of them is primary it follows that one, otherwise the most up to date
+// replica (highest epoch, then seq, then earliest in the list) promotes itself
+// to primary of the next epoch. Replicas that start up join the same way.
+// Network partitions are not handled: two sides that cannot reach each other
+// will both end up with a primary.
+//
+// Replicas of a server with -auth authenticate to each other with AUTH
+// <token> before REPLICATE, or with their TLS client certificates.
+
+const (
+	heartbeatInterval = 500 * time.Millisecond
+	failureTimeout    = 2 * time.Second // silence after which the other side is considered dead
+
+	roleStarting = "starting"
+	rolePrimary  = "primary"
+	roleBackup   = "backup"
+)
+
+// logEntry is a command executed by a session, or the removal of a session
+type logEntry struct {
+	Seq     uint64 `json:"seq"`
+	Session string `json:"session"`
+	Owner   string `json:"owner,omitempty"` // identity the session belongs to
+	Key     string `json:"key,omitempty"`   // the request key, to answer retries on any replica
+	Command string `json:"command,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Drop    bool   `json:"drop,omitempty"`
+}
+
+// replicationMessage is a line sent from the primary to a backup
+type replicationMessage struct {
+	Snapshot  *snapshot `json:"snapshot,omitempty"`
+	Entry     *logEntry `json:"entry,omitempty"`
+	Heartbeat bool      `json:"heartbeat,omitempty"`
+}
+
+// snapshot is the state of every session after entry Seq
+type snapshot struct {
+	Epoch    uint64         `json:"epoch"`
+	Seq      uint64         `json:"seq"`
+	Sessions []sessionState `json:"sessions"`
+	Replies  []dedupState   `json:"replies,omitempty"`
+}
+
+// backupLink is the primary's side of the connection to a backup
+type backupLink struct {
+	addr   string
+	acked  uint64
+	notify chan struct{} // signaled when entries are appended
+	done   chan struct{} // closed when the backup is dropped
+}
+
+// Replica is this server's part in the replicated calculator
+type Replica struct {
+	self     string
+	replicas []string
+	sessions *SessionTable
+	dedup    *DedupTable
+	dial     func(addr string) (net.Conn, error) // connects to another replica
+	token    string                              // sent with AUTH before anything else, if set
+
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast when backups acknowledge or are dropped
+	role    string
+	primary string
+	epoch   uint64     // incremented by every promotion
+	seq     uint64     // last entry appended (primary) or applied (backup)
+	entries []logEntry // entries some backup has not acknowledged yet
+	backups map[string]*backupLink
+}
+
+func NewReplica(self string, replicas []string, dedup *DedupTable) *Replica {
+	r := &Replica{self: self, replicas: replicas, dedup: dedup, role: roleStarting, backups: make(map[string]*backupLink)}
+	r.dial = func(addr string) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, failureTimeout)
+	}
+	r.changed = sync.NewCond(&r.mu)
+	r.sessions = NewSessionTable(r)
+	return r
+}
+
+// Record appends a command to the log; the returned function waits until
+// every backup has acknowledged it. The reply of a keyed request is noted
+// right away, so that snapshots hold the replies of the entries they cover.
+func (r *Replica) Record(session, owner, key, command, modeSpec string, reply Reply) func() {
+	seq := r.append(logEntry{Session: session, Owner: owner, Key: key, Command: command, Mode: modeSpec}, func() {
+		if key != "" {
+			r.dedup.Executed(key, reply)
+		}
+	})
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for r.pending(seq) {
+			r.changed.Wait()
+		}
+	}
+}
+
+// RecordDrop appends the removal of a session to the log
+func (r *Replica) RecordDrop(session string) {
+	r.append(logEntry{Session: session, Drop: true}, nil)
+}
+
+// append adds an entry to the log, running locked with the log locked
+func (r *Replica) append(e logEntry, locked func()) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if locked != nil {
+		locked()
+	}
+	r.seq++
+	e.Seq = r.seq
+	if len(r.backups) > 0 {
+		r.entries = append(r.entries, e)
+	}
+	for _, b := range r.backups {
+		select {
+		case b.notify <- struct{}{}:
+		default:
+		}
+	}
+	return r.seq
+}
+
+// pending reports whether a backup has not acknowledged seq yet. Called with mu held.
+func (r *Replica) pending(seq uint64) bool {
+	for _, b := range r.backups {
+		if b.acked < seq {
+			return true
+		}
+	}
+	return false
+}
+
+// serving returns the error answered to clients unless this is the primary
+func (r *Replica) serving() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.role == rolePrimary:
+		return nil
+	case r.primary != "":
+		return notPrimaryError(r.primary)
+	}
+	return notPrimaryError("")
+}
+
+// notPrimaryError names the primary, if known
+type notPrimaryError string
+
+func (e notPrimaryError) Error() string {
+	if e == "" {
+		return protocol.NotPrimaryMessage + ", no primary is elected yet"
+	}
+	return protocol.NotPrimaryMessage + ", the primary is " + string(e)
+}
+
+func (e notPrimaryError) Code() string {
+	return protocol.CodeNotPrimary
+}
+
+// Role answers the ROLE command
+func (r *Replica) Role() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	role := fmt.Sprintf("ROLE %s %d %d", r.role, r.epoch, r.seq)
+	if r.role == roleBackup {
+		role += " " + r.primary
+	}
+	return role
+}
+
+// Run finds or becomes the primary, and follows it for as long as this
+// replica is a backup
+func (r *Replica) Run() {
+	for {
+		primary := r.findPrimary()
+		if primary == r.self {
+			return
+		}
+		err := r.follow(primary)
+		fmt.Printf("Lost primary %s: %v\n", primary, err)
+	}
+}
+
+// findPrimary asks the other replicas for their role until one of them is
+// the primary, or promotes this replica if it is the best candidate
+func (r *Replica) findPrimary() string {
+	r.mu.Lock()
+	r.role = roleStarting
+	r.primary = ""
+	r.mu.Unlock()
+	for {
+		type candidate struct {
+			addr       string
+			epoch, seq uint64
+		}
+		r.mu.Lock()
+		best := candidate{r.self, r.epoch, r.seq}
+		r.mu.Unlock()
+		for _, addr := range r.replicas {
+			if addr == r.self {
+				continue
+			}
+			fields, err := r.askRole(addr)
+			if err != nil {
+				continue
+			}
+			if fields[1] == rolePrimary {
+				return addr
+			}
+			epoch, _ := strconv.ParseUint(fields[2], 10, 64)
+			seq, _ := strconv.ParseUint(fields[3], 10, 64)
+			if epoch > best.epoch || epoch == best.epoch && (seq > best.seq ||
+				seq == best.seq && slices.Index(r.replicas, addr) < slices.Index(r.replicas, best.addr)) {
+				best = candidate{addr, epoch, seq}
+			}
+		}
+		if best.addr == r.self {
+			r.promote()
+			return r.self
+		}
+		time.Sleep(heartbeatInterval) // Give the better candidate time to take over
+	}
+}
+
+// askRole sends ROLE to a replica and returns the fields of its answer
+func (r *Replica) askRole(addr string) ([]string, error) {
+	conn, err := r.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(failureTimeout))
+	fmt.Fprintln(conn, "ROLE")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "ROLE" {
+		return nil, fmt.Errorf("invalid role %q", strings.TrimSpace(line))
+	}
+	return fields, nil
+}
+
+func (r *Replica) promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.epoch++
+	r.role = rolePrimary
+	r.primary = r.self
+	fmt.Printf("Now primary of epoch %d, after entry %d\n", r.epoch, r.seq)
+}
+
+// follow replicates the primary until the connection to it fails
+func (r *Replica) follow(primary string) error {
+	conn, err := r.dial(primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 64<<20) // Snapshots hold every session
+	if r.token != "" {
+		conn.SetDeadline(time.Now().Add(failureTimeout))
+		fmt.Fprintf(conn, "AUTH %s\n", r.token)
+		if !scanner.Scan() {
+			return fmt.Errorf("authenticating: %v", scanner.Err())
+		}
+		if reply := scanner.Text(); !strings.HasPrefix(reply, "OK ") {
+			return fmt.Errorf("authenticating: %s", reply)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	if _, err := fmt.Fprintf(conn, "REPLICATE %s\n", r.self); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.role = roleBackup
+	r.primary = primary
+	r.mu.Unlock()
+	fmt.Printf("Following primary %s\n", primary)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(failureTimeout))
+		if !scanner.Scan() {
+			if scanner.Err() != nil {
+				return scanner.Err()
+			}
+			return fmt.Errorf("connection closed")
+		}
+		var msg replicationMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+		switch {
+		case msg.Snapshot != nil:
+			if err := r.sessions.Replace(msg.Snapshot.Sessions); err != nil {
+				return fmt.Errorf("invalid snapshot: %w", err)
+			}
+			r.dedup.Replace(msg.Snapshot.Replies)
+			r.mu.Lock()
+			r.epoch, r.seq = msg.Snapshot.Epoch, msg.Snapshot.Seq
+			r.mu.Unlock()
+		case msg.Entry != nil:
+			if e := msg.Entry; e.Drop {
+				r.sessions.Remove(e.Session)
+			} else {
+				session := r.sessions.getOrCreate(e.Session, e.Owner)
+				// The primary's session may have been claimed by AUTH since
+				session.claim(e.Owner)
+				reply := session.Apply(e.Command, e.Mode)
+				if e.Key != "" {
+					r.dedup.Store(e.Key, reply)
+				}
+			}
+			r.mu.Lock()
+			r.seq = msg.Entry.Seq
+			r.mu.Unlock()
+		}
+		r.mu.Lock()
+		seq := r.seq
+		r.mu.Unlock()
+		if _, err := fmt.Fprintf(conn, "ACK %d\n", seq); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeBackup streams the log to a backup that sent REPLICATE over conn,
+// reading its acknowledgements from scanner
+func (r *Replica) ServeBackup(conn net.Conn, scanner *bufio.Scanner, addr string) {
+	if err := r.serving(); err != nil {
+		fmt.Fprintf(conn, "Error: %v\n", err)
+		return
+	}
+	b := &backupLink{addr: addr, notify: make(chan struct{}, 1), done: make(chan struct{})}
+	var snap snapshot
+	snap.Sessions = r.sessions.Snapshot(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if old, ok := r.backups[addr]; ok {
+			r.drop(old)
+		}
+		snap.Epoch, snap.Seq = r.epoch, r.seq
+		snap.Replies = r.dedup.States()
+		b.acked = r.seq
+		r.backups[addr] = b
+	})
+	fmt.Printf("Backup %s joined at entry %d\n", addr, snap.Seq)
+	go r.sendLog(conn, b, snap)
+
+	for scanner.Scan() {
+		seq, ok := strings.CutPrefix(scanner.Text(), "ACK ")
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if !ok || err != nil {
+			fmt.Printf("Invalid acknowledgement from backup %s: %s\n", addr, scanner.Text())
+			break
+		}
+		r.ack(b, n)
+	}
+	r.mu.Lock()
+	if r.backups[addr] == b {
+		r.drop(b)
+		fmt.Printf("Backup %s dropped\n", addr)
+	}
+	r.mu.Unlock()
+}
+
+// sendLog writes the snapshot and then the log entries to a backup
+func (r *Replica) sendLog(conn net.Conn, b *backupLink, snap snapshot) {
+	defer conn.Close() // Ends ServeBackup
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	conn.SetWriteDeadline(time.Now().Add(failureTimeout))
+	if err := enc.Encode(replicationMessage{Snapshot: &snap}); err != nil {
+		return
+	}
+	next := snap.Seq + 1
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		conn.SetWriteDeadline(time.Now().Add(failureTimeout))
+		r.mu.Lock()
+		var batch []logEntry
+		for _, e := range r.entries {
+			if e.Seq >= next {
+				batch = append(batch, e)
+			}
+		}
+		r.mu.Unlock()
+		for i := range batch {
+			if err := enc.Encode(replicationMessage{Entry: &batch[i]}); err != nil {
+				return
+			}
+			next = batch[i].Seq + 1
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-b.notify:
+		case <-heartbeat.C:
+			if err := enc.Encode(replicationMessage{Heartbeat: true}); err != nil {
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// ack records that a backup has applied every entry up to seq
+func (r *Replica) ack(b *backupLink, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq > b.acked {
+		b.acked = seq
+		r.trim()
+		r.changed.Broadcast()
+	}
+}
+
+// drop stops replicating to a backup. Called with mu held.
+func (r *Replica) drop(b *backupLink) {
+	delete(r.backups, b.addr)
+	close(b.done)
+	r.trim()
+	r.changed.Broadcast()
+}
+
+// trim forgets the entries every backup has acknowledged. Called with mu held.
+func (r *Replica) trim() {
+	acked := r.seq
+	for _, b := range r.backups {
+		acked = min(acked, b.acked)
+	}
+	i := 0
+	for i < len(r.entries) && r.entries[i].Seq <= acked {
+		i++
+	}
+	r.entries = r.entries[i:]
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/protocol"
+	"sd/transport"
+)
+
+// audit checks the peers' mutual exclusion, nil unless -audit is given
+var audit *Auditor
+
+// replica is the server's part in a replicated calculator, nil unless
+// -replicas is given
+var replica *Replica
+
+// sessions holds the sessions of all connections
+var sessions *SessionTable
+
+// dedup answers retried requests
+var dedup *DedupTable
+
+// auth authenticates and authorizes the clients, nil unless -auth is given
+var auth *Authenticator
+
+// limits holds the clients' rate limits and the concurrency cap
+var limits *Limiter
+
+// Handle incoming connections; closing is closed when the server shuts down
+func handleConnection(conn net.Conn, closing <-chan struct{}) {
+	defer conn.Close()
+	fmt.Printf("New connection from %s\n", conn.RemoteAddr().String())
+
+	reader := &timedReader{conn: conn, idle: config.IdleTimeout.Duration, read: config.ReadTimeout.Duration, closing: closing}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, min(4096, config.MaxLineLength)), config.MaxLineLength)
+	// Who the client authenticated as, nil until it does
+	var identity *Identity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(config.ReadTimeout.Duration))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if cn := transport.PeerCommonName(tlsConn.ConnectionState()); cn != "" && auth != nil {
+			if identity = auth.ByCert(cn); identity != nil {
+				fmt.Printf("Connection from %s authenticated as %s by certificate\n", conn.RemoteAddr(), identity.Name)
+			}
+		}
+	}
+
+	out := newResponseWriter(conn)
+	defer out.Close()
+	session := sessions.Create(ownerName(identity))
+	proto := protocol.Text
+	// Pipelined requests still being evaluated or written
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+	first := true
+	for scanner.Scan() {
+		// After a timeout the scanner still hands over the unfinished line
+		if reader.timedOut {
+			break
+		}
+		line := scanner.Text()
+		id, mode := uint64(0), ""
+		key, command := protocol.CutRequestKey(line)
+		var invalid error
+		if proto != protocol.Text {
+			var req protocol.Request
+			if invalid = json.Unmarshal([]byte(line), &req); invalid == nil {
+				id, key, command, mode = req.ID, req.Key, req.Command, req.Mode
+			}
+		}
+		fields := strings.Fields(command)
+		logCommand(identity, line, fields)
+		if invalid != nil {
+			out.WriteJSON(protocol.Response{Error: &protocol.ResponseError{Code: protocol.CodeInvalidRequest, Message: invalid.Error()}})
+			continue
+		}
+
+		// Commands are counted against the limits before they are even checked,
+		// so that a client cannot flood the server with refused ones either.
+		// Replicas have to find each other under any load.
+		release, err := func() {}, error(nil)
+		if len(fields) == 0 || fields[0] != "ROLE" && fields[0] != "REPLICATE" {
+			release, err = limits.Admit(limitKey(conn.RemoteAddr().String(), identity))
+		}
+		if err == nil {
+			if err = admit(identity, command); err != nil {
+				release()
+			}
+		}
+		if err != nil {
+			if proto == protocol.Text {
+				out.WriteLine(Reply{Err: err}.Line())
+			} else {
+				out.WriteJSON(Reply{Err: err}.Response(id))
+			}
+			continue
+		}
+		// A backup replica connecting to the primary
+		if len(fields) == 2 && fields[0] == "REPLICATE" && first && proto == protocol.Text && replica != nil {
+			release()
+			sessions.Remove(session.ID)
+			reader.idle = failureTimeout
+			replica.ServeBackup(conn, scanner, fields[1])
+			return
+		}
+		first = first && len(fields) > 0 && fields[0] == "AUTH"
+		// Keys are unique per client, so that no one gets the replies of another
+		if key != "" && identity != nil {
+			key = identity.Name + "/" + key
+		}
+
+		if proto == protocol.Pipeline {
+			if !isBarrier(command) {
+				out.Reserve()
+				inflight.Add(1)
+				jobs <- job{session: session, id: id, key: key, command: command, mode: mode, done: func(resp protocol.Response) {
+					out.Queue(resp, func() {
+						release()
+						inflight.Done()
+					})
+				}}
+				continue
+			}
+			inflight.Wait()
+		}
+
+		// A protocol switch is answered in the protocol it was requested in
+		requested := proto
+		var reply Reply
+		if name, ok := strings.CutPrefix(strings.TrimSpace(command), "PROTOCOL "); ok {
+			reply = switchProtocol(&proto, strings.TrimSpace(name))
+		} else if len(fields) > 0 && fields[0] == "SESSION" {
+			reply = resumeSession(&session, identity, fields[1:])
+		} else if len(fields) > 0 && fields[0] == "AUTH" {
+			reply = authenticate(&identity, &session, fields[1:])
+		} else {
+			reply = executeOnce(session, key, command, mode)
+		}
+
+		if requested == protocol.Text {
+			out.WriteLine(reply.Line())
+		} else {
+			out.WriteJSON(reply.Response(id))
+		}
+		release()
+	}
+
+	err := scanner.Err()
+	switch {
+	case err == nil:
+	case errors.Is(err, bufio.ErrTooLong):
+		fmt.Printf("Closing connection from %s: request longer than %d bytes\n", conn.RemoteAddr(), config.MaxLineLength)
+		inflight.Wait()
+		reply := Reply{Err: calculator.UsageError(fmt.Sprintf("Request longer than %d bytes", config.MaxLineLength))}
+		if proto == protocol.Text {
+			out.WriteLine(reply.Line())
+		} else {
+			resp := reply.Response(0)
+			resp.Error.Code = protocol.CodeInvalidRequest
+			out.WriteJSON(resp)
+		}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// A read deadline is also how a shutdown stops reading further requests
+		select {
+		case <-closing:
+		default:
+			if reader.midRequest {
+				fmt.Printf("Closing connection from %s: request not received within %v\n", conn.RemoteAddr(), reader.read)
+			} else {
+				fmt.Printf("Closing connection from %s: idle for %v\n", conn.RemoteAddr(), reader.idle)
+			}
+		}
+	case errors.Is(err, net.ErrClosed):
+		// Closed after a failed write, which was logged
+	default:
+		fmt.Printf("Connection error: %v\n", err)
+	}
+}
+
+// shutdownTimeout bounds how long a shutdown waits for in-flight requests
+const shutdownTimeout = 10 * time.Second
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errTooManyConns = errors.New("too many connections, try again later")
+)
+
+// connSet tracks the open client connections for a graceful shutdown and
+// limits how many there are
+type connSet struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	max     int // 0 for no limit
+	wg      sync.WaitGroup
+	closing chan struct{} // closed when the server shuts down
+}
+
+func newConnSet(max int) *connSet {
+	return &connSet{conns: make(map[net.Conn]bool), max: max, closing: make(chan struct{})}
+}
+
+// add registers a new connection, unless the server is shutting down or
+// already has as many connections as allowed
+func (cs *connSet) add(conn net.Conn) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	select {
+	case <-cs.closing:
+		return errShuttingDown
+	default:
+	}
+	if cs.max > 0 && len(cs.conns) >= cs.max {
+		return errTooManyConns
+	}
+	cs.conns[conn] = true
+	cs.wg.Add(1)
+	return nil
+}
+
+func (cs *connSet) remove(conn net.Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.conns, conn)
+	cs.wg.Done()
+}
+
+// drain stops reading requests from every connection and waits until the
+// requests already received are answered, closing whatever is left after
+// timeout
+func (cs *connSet) drain(timeout time.Duration) {
+	cs.mu.Lock()
+	close(cs.closing)
+	for conn := range cs.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	cs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		cs.mu.Lock()
+		fmt.Printf("Closing %d connections with unfinished requests\n", len(cs.conns))
+		for conn := range cs.conns {
+			conn.Close()
+		}
+		cs.mu.Unlock()
+	}
+}
+
+// admit returns the error a command is refused with before it is evaluated:
+// until the client authenticates only AUTH, PROTOCOL and ROLE are answered,
+// then the operations its identity allows, and backups only tell their role
+func admit(identity *Identity, command string) error {
+	fields := strings.Fields(command)
+	if len(fields) > 0 && (fields[0] == "AUTH" || fields[0] == "PROTOCOL" || fields[0] == "ROLE") {
+		return nil
+	}
+	if auth != nil {
+		if err := auth.Authorize(identity, command); err != nil {
+			return err
+		}
+	}
+	if replica != nil && (len(fields) == 0 || fields[0] != "REPLICATE") {
+		return replica.serving()
+	}
+	return nil
+}
+
+// authenticate answers AUTH <token>, identifying the client of a connection
+func authenticate(identity **Identity, session **Session, args []string) Reply {
+	if len(args) != 1 {
+		return Reply{Err: calculator.UsageError("Invalid format. Use AUTH <token>")}
+	}
+	if auth == nil {
+		return textReply("OK anonymous")
+	}
+	id := auth.ByToken(args[0])
+	if id == nil {
+		return Reply{Err: errInvalidToken}
+	}
+	*identity = id
+	// The connection's session is the identity's from now on, unless it
+	// belongs to another one
+	if !(*session).claim(id.Name) {
+		*session = sessions.Create(id.Name)
+	}
+	return textReply("OK " + id.Name)
+}
+
+// logCommand logs a received request line with the client's identity, if
+// the server authenticates clients, leaving out tokens and session IDs
+func logCommand(identity *Identity, line string, fields []string) {
+	// Tokens and session IDs let anyone reading the log act as the client
+	switch {
+	case len(fields) > 0 && fields[0] == "AUTH":
+		line = "AUTH <token>"
+	case len(fields) > 1 && fields[0] == "SESSION":
+		line = "SESSION <id>"
+	}
+	switch {
+	case auth == nil:
+		fmt.Printf("Received command: %s\n", line)
+	case identity == nil:
+		fmt.Printf("Received command from unauthenticated client: %s\n", line)
+	default:
+		fmt.Printf("Received command from %s: %s\n", identity.Name, line)
+	}
+}
+
+// switchProtocol changes the protocol of a connection to name
+func switchProtocol(proto *string, name string) Reply {
+	if name != protocol.Text && name != protocol.JSON && name != protocol.Pipeline {
+		return Reply{Err: calculator.UsageError("Unknown protocol. Supported protocols: text, json, pipeline")}
+	}
+	*proto = name
+	return textReply("OK " + name)
+}
+
+// resumeSession answers SESSION with the ID of the connection's session, and
+// switches the connection to another session with SESSION <id>
+func resumeSession(session **Session, identity *Identity, args []string) Reply {
+	switch len(args) {
+	case 0:
+	case 1:
+		s := sessions.Get(args[0])
+		if s == nil {
+			return Reply{Err: calculator.Errorf(protocol.CodeUnknownSession, "unknown session %q", args[0])}
+		}
+		if s.Owner() != ownerName(identity) {
+			return Reply{Err: errSessionOwner}
+		}
+		if *session != s {
+			dropSession((*session).ID)
+			*session = s
+		}
+	default:
+		return Reply{Err: calculator.UsageError("Invalid format. Use SESSION [<id>]")}
+	}
+	return textReply("Session " + (*session).ID)
+}
+
+// expireSessions removes the sessions unused for longer than ttl; a backup
+// leaves that to its primary
+func expireSessions(ttl time.Duration) {
+	for range time.Tick(ttl / 10) {
+		if replica != nil && replica.serving() != nil {
+			continue
+		}
+		for _, id := range sessions.Idle(ttl) {
+			dropSession(id)
+		}
+	}
+}
+
+// dropSession removes a session, on the backups as well
+func dropSession(id string) {
+	sessions.Remove(id)
+	if replica != nil {
+		replica.RecordDrop(id)
+	}
+}
+
+// executeOnce runs a command carrying a request key at most once: a retry of
+// an executed request gets the first reply, one of a request still being
+// executed waits for it
+func executeOnce(session *Session, key, command, mode string) Reply {
+	if key == "" {
+		return execute(session, "", command, mode)
+	}
+	e, first := dedup.Claim(key)
+	if !first {
+		<-e.done
+		fmt.Printf("Answering retried request %s with its first reply\n", key)
+		return e.reply
+	}
+	reply := execute(session, key, command, mode)
+	dedup.Complete(key, reply)
+	return reply
+}
+
+// execute runs a single command of a session, mode is the numeric mode
+// requested for it or empty and key the request key
+func execute(session *Session, key, command, mode string) Reply {
+	parts := strings.Fields(command)
+	// Peers tag their requests as AUDIT <id> <round> <command>, and end
+	// their critical section with AUDIT <id> <round> END
+	if len(parts) > 0 && parts[0] == "AUDIT" {
+		if len(parts) < 4 {
+			return Reply{Err: calculator.UsageError("Invalid format. Use AUDIT <id> <round> <command>")}
+		}
+		round, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return Reply{Err: calculator.UsageError("Invalid round provided.")}
+		}
+		if parts[3] == "END" {
+			if audit != nil {
+				audit.Exit(parts[1], round)
+			}
+			return textReply("Released")
+		}
+		if audit != nil {
+			audit.Enter(parts[1], round)
+		}
+		parts = parts[3:]
+	}
+
+	if len(parts) == 1 && parts[0] == "ROLE" {
+		if replica == nil {
+			return textReply("ROLE primary 0 0")
+		}
+		return textReply(replica.Role())
+	}
+
+	if len(parts) == 1 && parts[0] == "STATS" {
+		if audit == nil {
+			return textReply("Audit mode disabled")
+		}
+		return textReply(audit.Stats())
+	}
+
+	return session.Execute(key, strings.Join(parts, " "), mode)
+}
+
+func main() {
+	configFile := flag.String("config", "", "JSON file with the server settings, flags override it")
+	flag.StringVar(&config.Listen, "listen", config.Listen, "address to listen on")
+	flag.IntVar(&config.MaxConns, "max-conns", config.MaxConns, "maximum concurrent connections, 0 for no limit")
+	flag.DurationVar(&config.IdleTimeout.Duration, "idle-timeout", config.IdleTimeout.Duration, "close connections idle between requests for this long")
+	flag.DurationVar(&config.ReadTimeout.Duration, "read-timeout", config.ReadTimeout.Duration, "close connections that take longer to send a started request")
+	flag.DurationVar(&config.WriteTimeout.Duration, "write-timeout", config.WriteTimeout.Duration, "close connections that do not accept a response for this long")
+	flag.IntVar(&config.MaxLineLength, "max-line", config.MaxLineLength, "maximum length of a request line in bytes")
+	flag.BoolVar(&config.Audit, "audit", config.Audit, "record the peers' critical sections and report overlaps")
+	flag.IntVar(&config.Workers, "workers", config.Workers, "number of workers evaluating pipelined requests")
+	flag.DurationVar(&config.DedupTTL.Duration, "dedup-ttl", config.DedupTTL.Duration, "how long the replies to requests with a key are kept for retries")
+	flag.Func("replicas", "comma separated host:port of every replica of a replicated server, including this one", func(s string) error {
+		config.Replicas = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&config.Advertise, "advertise", config.Advertise, "this server's entry in -replicas, by default the listen address with localhost as host")
+	flag.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "commands per second allowed to each client, 0 for no limit")
+	flag.IntVar(&config.RateBurst, "rate-burst", config.RateBurst, "commands a client may send at once above -rate-limit, by default one second's worth")
+	flag.IntVar(&config.MaxInflight, "max-inflight", config.MaxInflight, "maximum commands evaluated at once, 0 for no limit")
+	flag.StringVar(&config.AuthFile, "auth", config.AuthFile, "JSON file with the identities of the clients, which then have to authenticate")
+	flag.StringVar(&config.ReplicaToken, "replica-token", config.ReplicaToken, "token the replicas authenticate to each other with")
+	flag.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "certificate file, the server only accepts TLS connections if given")
+	flag.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "private key file of -tls-cert")
+	flag.StringVar(&config.ClientCA, "client-ca", config.ClientCA, "CA file verifying the certificates clients authenticate with")
+	flag.StringVar(&config.HTTPListen, "http", config.HTTPListen, "address of the HTTP gateway, none by default")
+	flag.StringVar(&config.TLSCA, "tls-ca", config.TLSCA, "CA file verifying the other replicas' certificates, by default the system's")
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, &config); err != nil {
+			fmt.Println("Error reading config:", err)
+			os.Exit(2)
+		}
+		// Parsed again so that the flags given take precedence over the file
+		flag.Parse()
+	}
+	if err := config.validate(); err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(2)
+	}
+
+	// Client certificates are optional, clients may authenticate with a token
+	clientTransport, err := transport.New(transport.TLSFiles{Cert: config.TLSCert, Key: config.TLSKey, CA: config.ClientCA}, tls.VerifyClientCertIfGiven)
+	if err != nil {
+		fmt.Println("Error loading TLS certificate:", err)
+		os.Exit(2)
+	}
+	if config.AuthFile != "" {
+		var err error
+		if auth, err = LoadAuthenticator(config.AuthFile); err != nil {
+			fmt.Println("Error loading identities:", err)
+			os.Exit(2)
+		}
+		fmt.Printf("Authentication enabled, %d identities\n", len(auth.Identities))
+	}
+
+	startWorkers(config.Workers)
+	limits = NewLimiter(config.RateLimit, config.RateBurst, config.MaxInflight)
+	dedup = NewDedupTable(config.DedupTTL.Duration)
+	if len(config.Replicas) > 0 {
+		self := config.Advertise
+		if self == "" {
+			self = advertisedAddr(config.Listen)
+		}
+		if !slices.Contains(config.Replicas, self) {
+			fmt.Printf("Invalid config: %s is not one of the replicas %s\n", self, strings.Join(config.Replicas, ","))
+			os.Exit(2)
+		}
+		replica = NewReplica(self, config.Replicas, dedup)
+		replica.token = config.ReplicaToken
+		// Replicas present their own certificate as client certificate
+		replicaTransport, err := transport.New(transport.TLSFiles{TLS: clientTransport.Secure(), Cert: config.TLSCert, Key: config.TLSKey, CA: config.TLSCA}, tls.NoClientCert)
+		if err != nil {
+			fmt.Println("Error loading TLS certificate:", err)
+			os.Exit(2)
+		}
+		replica.dial = func(addr string) (net.Conn, error) {
+			return replicaTransport.DialTimeout(addr, failureTimeout)
+		}
+		sessions = replica.sessions
+	} else {
+		sessions = NewSessionTable(nil)
+	}
+	go expireSessions(2 * config.IdleTimeout.Duration)
+	if config.Audit {
+		audit = NewAuditor()
+		fmt.Println("Audit mode enabled")
+	}
+
+	listener, err := clientTransport.Listen(config.Listen)
+	if err != nil {
+		fmt.Println("Error starting server:", err)
+		return
+	}
+	defer listener.Close()
+	if clientTransport.Secure() {
+		fmt.Printf("Server is listening on %s with TLS\n", listener.Addr())
+	} else {
+		fmt.Printf("Server is listening on %s\n", listener.Addr())
+	}
+	var gateway *http.Server
+	if config.HTTPListen != "" {
+		if gateway, err = startGateway(clientTransport, config.HTTPListen); err != nil {
+			fmt.Println("Error starting HTTP gateway:", err)
+			return
+		}
+	}
+	if replica != nil {
+		go replica.Run()
+	}
+
+	// SIGINT or SIGTERM stop accepting connections; a second one stops the
+	// server right away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	conns := newConnSet(config.MaxConns)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		if err := conns.add(conn); err != nil {
+			fmt.Printf("Refusing connection from %s: %v\n", conn.RemoteAddr(), err)
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintf(conn, "Error: %v\n", err)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conns.remove(conn)
+			handleConnection(conn, conns.closing)
+		}()
+	}
+	stop()
+
+	fmt.Println("Shutting down, finishing in-flight requests...")
+	gatewayStopped := make(chan struct{})
+	go func() {
+		defer close(gatewayStopped)
+		if gateway != nil {
+			stopGateway(gateway)
+		}
+	}()
+	conns.drain(shutdownTimeout)
+	<-gatewayStopped
+	fmt.Println("Server stopped")
+}
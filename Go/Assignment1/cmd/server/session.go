@@ -0,0 +1,491 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"sd/Assignment1/calculator"
+	"sd/Assignment1/protocol"
+)
+
+// maxHistory is the number of commands a session remembers
+const maxHistory = 100
+
+// Reply is the outcome of a command, independent of the protocol used to send
+// it back: a Result, a Text for commands that do not calculate, or an error.
+// Results of the exact numeric modes are also kept as exact Value.
+type Reply struct {
+	Result *float64
+	Value  string
+	Mode   string
+	Text   string
+	Err    error
+}
+
+func resultReply(mode calculator.Mode, result calculator.Number, err error) Reply {
+	if err != nil {
+		return Reply{Err: err}
+	}
+	reply := Reply{Mode: mode.Name()}
+	f := result.Float64()
+	if !result.Exact() {
+		reply.Result = &f
+		return reply
+	}
+	reply.Value = mode.Format(result)
+	if !math.IsInf(f, 0) {
+		reply.Result = &f
+	}
+	return reply
+}
+
+func textReply(text string) Reply {
+	return Reply{Text: text}
+}
+
+// Line renders the reply for the text protocol
+func (r Reply) Line() string {
+	var usage calculator.UsageError
+	switch {
+	case errors.As(r.Err, &usage):
+		return usage.Error()
+	case r.Err != nil:
+		return fmt.Sprintf("Error: %v", r.Err)
+	case r.Value != "":
+		return "Result: " + r.Value
+	case r.Result != nil:
+		return fmt.Sprintf("Result: %f", *r.Result)
+	}
+	return r.Text
+}
+
+// Response renders the reply for the JSON protocol
+func (r Reply) Response(id uint64) protocol.Response {
+	resp := protocol.Response{ID: id, Result: r.Result, Value: r.Value, Mode: r.Mode, Text: r.Text}
+	if r.Value == "" && r.Result != nil && (math.IsInf(*r.Result, 0) || math.IsNaN(*r.Result)) {
+		// JSON has no representation for these
+		resp.Result = nil
+		resp.Error = &protocol.ResponseError{Code: protocol.CodeDomainError, Message: fmt.Sprintf("result %f is not finite", *r.Result)}
+	}
+	if r.Err != nil {
+		var coded interface{ Code() string }
+		code := protocol.CodeInvalidFormat
+		if errors.As(r.Err, &coded) {
+			code = coded.Code()
+		}
+		resp.Error = &protocol.ResponseError{Code: code, Message: r.Err.Error()}
+		var retry interface{ RetryAfter() time.Duration }
+		if errors.As(r.Err, &retry) {
+			resp.Error.RetryAfterMs = retry.RetryAfter().Milliseconds()
+		}
+	}
+	return resp
+}
+
+// historyEntry is one command of a session together with its response
+type historyEntry struct {
+	Command  string `json:"command"`
+	Response string `json:"response"`
+}
+
+// Session is the state of one client connection: its variables, including the
+// ans register holding the last result, its numeric mode and the commands it
+// sent.
+//
+//	let <name> = <command>   stores the result of a command in a variable
+//	history                  lists the past commands and their results
+//	mode [<mode>]            shows or sets the numeric mode, e.g. mode decimal:2
+//	@<mode> <command>        runs a single command in another numeric mode
+type Session struct {
+	ID       string
+	owner    string     // identity that created the session, empty without authentication
+	journal  Journal    // nil unless the commands are replicated
+	mu       sync.Mutex // held to read and commit the state, not while evaluating
+	vars     map[string]calculator.Number
+	mode     calculator.Mode
+	history  []historyEntry
+	lastUsed time.Time
+	version  uint64            // incremented by every command committed
+	changed  map[string]uint64 // version that last set each variable, and "mode"
+}
+
+// Journal records the commands sessions execute, in the order they do, with
+// the request key and reply of each. The returned function waits until the
+// command is safely recorded.
+type Journal interface {
+	Record(session, owner, key, command, modeSpec string, reply Reply) (wait func())
+}
+
+func NewSession(id, owner string, journal Journal) *Session {
+	return &Session{ID: id, owner: owner, journal: journal, vars: make(map[string]calculator.Number), mode: calculator.DefaultMode, lastUsed: time.Now(),
+		changed: make(map[string]uint64)}
+}
+
+// Execute runs a command of the session. A non-empty modeSpec selects the
+// numeric mode of this command only, like an @<mode> prefix. With a journal
+// the reply is only returned once the command is recorded; key is the
+// client's request key, if any.
+//
+// Pipelined requests of a session are evaluated concurrently, each on a
+// snapshot of the variables it names, and committed in turn. A command whose
+// variables or mode another one changed in the meantime is evaluated again,
+// so that the result is the one of the committed order, which backups replay.
+func (s *Session) Execute(key, command, modeSpec string) Reply {
+	s.mu.Lock()
+	reply, ok := s.control(command)
+	if !ok {
+		e := s.prepare(command, modeSpec)
+		s.mu.Unlock()
+		e.run()
+		s.mu.Lock()
+		if s.stale(e) {
+			e = s.prepare(command, modeSpec)
+			e.run()
+		}
+		reply = s.commit(e)
+	}
+	var wait func()
+	if s.journal != nil {
+		wait = s.journal.Record(s.ID, s.owner, key, command, modeSpec, reply)
+	}
+	s.mu.Unlock()
+	if wait != nil {
+		wait()
+	}
+	return reply
+}
+
+// Apply runs a command recorded by the journal of another server
+func (s *Session) Apply(command, modeSpec string) Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reply, ok := s.control(command); ok {
+		return reply
+	}
+	e := s.prepare(command, modeSpec)
+	e.run()
+	return s.commit(e)
+}
+
+// Owner returns the name of the identity the session belongs to
+func (s *Session) Owner() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owner
+}
+
+// claim gives an ownerless session to owner, reporting whether the session
+// is owner's now
+func (s *Session) claim(owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == "" {
+		s.owner = owner
+	}
+	return s.owner == owner
+}
+
+// control runs the commands that do not calculate, history and mode, called
+// with mu held
+func (s *Session) control(command string) (Reply, bool) {
+	s.lastUsed = time.Now()
+	command = strings.TrimSpace(command)
+	switch fields := strings.Fields(command); {
+	case command == "history":
+		return textReply(s.History()), true
+	case len(fields) > 0 && fields[0] == "mode":
+		return s.setMode(fields[1:]), true
+	}
+	return Reply{}, false
+}
+
+// evaluation is a calculating command evaluated outside the session lock
+type evaluation struct {
+	command string // as sent, for the history
+	mode    calculator.Mode
+	name    string // variable set by let, if any
+	expr    string
+	vars    map[string]calculator.Number // snapshot of the variables expr names
+	version uint64                       // of the session when the snapshot was taken
+	result  calculator.Number
+	err     error
+}
+
+// prepare parses command and takes its snapshot, called with mu held
+func (s *Session) prepare(command, modeSpec string) *evaluation {
+	command = strings.TrimSpace(command)
+	e := &evaluation{command: command, version: s.version}
+	mode, rest, err := s.commandMode(command, modeSpec)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	if name, rhs, ok := cutLet(rest); ok {
+		if !validName(name) {
+			e.err = calculator.Errorf(protocol.CodeInvalidName, "%q cannot be used as a variable name", name)
+			return e
+		}
+		e.name, rest = name, rhs
+	}
+	e.mode, e.expr = mode, rest
+	e.vars = make(map[string]calculator.Number)
+	for _, name := range names(rest) {
+		if v, ok := s.vars[name]; ok {
+			e.vars[name] = v
+		}
+	}
+	return e
+}
+
+// run evaluates e, without the session lock
+func (e *evaluation) run() {
+	if e.err == nil {
+		e.result, e.err = calculator.Calculate(e.expr, e.mode, e.vars)
+	}
+}
+
+// stale reports whether a command committed since e's snapshot changed the
+// mode or a variable e names, called with mu held
+func (s *Session) stale(e *evaluation) bool {
+	if s.changed["mode"] > e.version {
+		return true
+	}
+	for _, name := range names(e.expr) {
+		if s.changed[name] > e.version {
+			return true
+		}
+	}
+	return false
+}
+
+// commit stores the result of e in ans, and in its variable for let, and adds
+// e to the history, called with mu held
+func (s *Session) commit(e *evaluation) Reply {
+	s.version++
+	if e.err == nil {
+		s.set("ans", e.result)
+		if e.name != "" {
+			s.set(e.name, e.result)
+		}
+	}
+	reply := resultReply(e.mode, e.result, e.err)
+	s.history = append(s.history, historyEntry{Command: e.command, Response: reply.Line()})
+	if len(s.history) > maxHistory {
+		s.history = s.history[1:]
+	}
+	return reply
+}
+
+func (s *Session) set(name string, n calculator.Number) {
+	s.vars[name] = n
+	s.changed[name] = s.version
+}
+
+// names returns the words of an expression or command that may name a
+// variable
+func names(expr string) []string {
+	return strings.FieldsFunc(expr, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// commandMode returns the numeric mode for command, which is the session's
+// unless modeSpec or an @<mode> prefix of command select another one, and
+// the command without that prefix
+func (s *Session) commandMode(command, modeSpec string) (calculator.Mode, string, error) {
+	if prefix, ok := strings.CutPrefix(command, "@"); ok {
+		modeSpec, command, _ = strings.Cut(prefix, " ")
+	}
+	if modeSpec == "" {
+		return s.mode, command, nil
+	}
+	mode, err := calculator.ParseMode(modeSpec)
+	return mode, command, err
+}
+
+func (s *Session) setMode(args []string) Reply {
+	switch len(args) {
+	case 0:
+	case 1:
+		mode, err := calculator.ParseMode(args[0])
+		if err != nil {
+			return Reply{Err: err}
+		}
+		s.version++
+		s.mode = mode
+		s.changed["mode"] = s.version
+	default:
+		return Reply{Err: calculator.UsageError("Invalid format. Use mode [float|int|rat|decimal[:digits]]")}
+	}
+	return textReply("Mode: " + s.mode.Name())
+}
+
+// cutLet splits "let <name> = <command>" into name and command
+func cutLet(command string) (name, rhs string, ok bool) {
+	rest, ok := strings.CutPrefix(command, "let ")
+	if !ok {
+		return "", "", false
+	}
+	name, rhs, ok = strings.Cut(rest, "=")
+	return strings.TrimSpace(name), strings.TrimSpace(rhs), ok
+}
+
+// History lists the past commands of the session on a single line
+func (s *Session) History() string {
+	if len(s.history) == 0 {
+		return "History: empty"
+	}
+	entries := make([]string, len(s.history))
+	for i, h := range s.history {
+		entries[i] = fmt.Sprintf("%d) %s -> %s", i+1, h.Command, h.Response)
+	}
+	return "History: " + strings.Join(entries, "; ")
+}
+
+// validName reports whether name may be assigned with let. Names of commands,
+// functions and the ans register are reserved.
+func validName(name string) bool {
+	if name == "" || name == "ans" || name == "let" || name == "history" || name == "mode" ||
+		calculator.LookupOperation(name) != nil {
+		return false
+	}
+	for i, r := range name {
+		if !(unicode.IsLetter(r) || r == '_' || i > 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionState is a session as transferred between servers. Numbers are
+// written as "f:<float>" or "r:<fraction>" to keep their exact value.
+type sessionState struct {
+	ID      string                       `json:"id"`
+	Owner   string                       `json:"owner,omitempty"`
+	Mode    string                       `json:"mode"`
+	Vars    map[string]calculator.Number `json:"vars,omitempty"`
+	History []historyEntry               `json:"history,omitempty"`
+}
+
+// state returns a copy of the session's state, called with mu held
+func (s *Session) state() sessionState {
+	return sessionState{ID: s.ID, Owner: s.owner, Mode: s.mode.Name(), Vars: maps.Clone(s.vars),
+		History: append([]historyEntry(nil), s.history...)}
+}
+
+// restoreSession recreates a session from its state
+func restoreSession(st sessionState, journal Journal) (*Session, error) {
+	s := NewSession(st.ID, st.Owner, journal)
+	mode, err := calculator.ParseMode(st.Mode)
+	if err != nil {
+		return nil, err
+	}
+	s.mode = mode
+	s.history = st.History
+	maps.Copy(s.vars, st.Vars)
+	return s, nil
+}
+
+// SessionTable holds the sessions of all connections by ID, so that a client
+// can resume its session on another connection with SESSION <id>
+type SessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	journal  Journal
+}
+
+func NewSessionTable(journal Journal) *SessionTable {
+	return &SessionTable{sessions: make(map[string]*Session), journal: journal}
+}
+
+// Create adds a new session with a random ID, owned by owner
+func (t *SessionTable) Create(owner string) *Session {
+	b := make([]byte, 8)
+	rand.Read(b)
+	s := NewSession(hex.EncodeToString(b), owner, t.journal)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[s.ID] = s
+	return s
+}
+
+// Get returns the session with the given ID, or nil
+func (t *SessionTable) Get(id string) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[id]
+}
+
+// getOrCreate returns the session with the given ID, creating it for owner
+// if needed
+func (t *SessionTable) getOrCreate(id, owner string) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[id]
+	if !ok {
+		s = NewSession(id, owner, t.journal)
+		t.sessions[id] = s
+	}
+	return s
+}
+
+// Remove forgets the session with the given ID
+func (t *SessionTable) Remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, id)
+}
+
+// Idle returns the IDs of the sessions unused for longer than ttl
+func (t *SessionTable) Idle(ttl time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ids []string
+	for id, s := range t.sessions {
+		s.mu.Lock()
+		if time.Since(s.lastUsed) > ttl {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+	}
+	return ids
+}
+
+// Snapshot returns the state of every session. The sessions are locked while
+// locked runs, so it sees the journal exactly at the point of the snapshot.
+func (t *SessionTable) Snapshot(locked func()) []sessionState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]sessionState, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		states = append(states, s.state())
+	}
+	locked()
+	return states
+}
+
+// Replace swaps all sessions for the ones of states
+func (t *SessionTable) Replace(states []sessionState) error {
+	sessions := make(map[string]*Session, len(states))
+	for _, st := range states {
+		s, err := restoreSession(st, t.journal)
+		if err != nil {
+			return fmt.Errorf("session %s: %w", st.ID, err)
+		}
+		sessions[st.ID] = s
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions = sessions
+	return nil
+}
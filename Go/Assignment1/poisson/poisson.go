@@ -1,4 +1,5 @@
-package main
+// Package poisson simulates the arrivals of a Poisson process.
+package poisson
 
 import (
     "log"
@@ -6,22 +7,22 @@ import (
     "math/rand"
 )
 
-// PoissonProcess simulates a Poisson process
-type PoissonProcess struct {
+// Process simulates a Poisson process
+type Process struct {
     lambda float64 // rate parameter
     rng    *rand.Rand // random number generator
 }
 
-// NewPoissonProcess creates a new PoissonProcess with a given rate and random seed
-func NewPoissonProcess(lambda float64, seed int64) *PoissonProcess {
+// NewProcess creates a new Process with a given rate and random seed
+func NewProcess(lambda float64, seed int64) *Process {
     if lambda <= 0 {
         log.Fatalf("Supplied rate parameter must be positive: %f", lambda)
     }
     rng := rand.New(rand.NewSource(seed))
-    return &PoissonProcess{lambda: lambda, rng: rng}
+    return &Process{lambda: lambda, rng: rng}
 }
 
 // TimeForNextEvent generates the time until the next event based on the exponential distribution
-func (pp *PoissonProcess) TimeForNextEvent() float64 {
+func (pp *Process) TimeForNextEvent() float64 {
     return -math.Log(1.0-pp.rng.Float64()) / pp.lambda
 }
\ No newline at end of file
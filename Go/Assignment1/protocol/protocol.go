@@ -0,0 +1,171 @@
+// Package protocol is what the calculator server and its clients share: the
+// requests, responses and error codes of the protocol described below and
+// the list of replicas a client fails over between.
+//
+// The server speaks a line based text protocol by default. A client switches
+// a connection to JSON lines by sending
+//
+//	PROTOCOL json
+//
+// which is answered with "OK json". From then on every line is a Request and
+// is answered by a Response with the same ID. A request with the command
+// "PROTOCOL text" switches back.
+//
+// "PROTOCOL pipeline" uses the same requests and responses, but the server
+// evaluates requests concurrently and answers each as soon as it is done,
+// so responses may come back out of order and are matched by ID. The
+// commands let, history and mode, AUDIT ... END and protocol switches are
+// barriers: they wait for every earlier request and are answered before any
+// later one is evaluated. What ans holds between barriers is unspecified.
+//
+// Every connection starts a new session. "SESSION" is answered with
+// "Session <id>", and "SESSION <id>" continues that session on the current
+// connection, e.g. after reconnecting to another replica.
+//
+// A request may carry a key, unique across all connections of all clients,
+// in the Key field or in the text protocol as "REQUEST <key> <command>". The
+// server executes a request with a given key only once: retries, e.g. after
+// a reconnect, get the reply of the first execution for some time.
+//
+// Servers started with -replicas form a primary-backup group. Only the
+// primary answers requests, the backups answer every request with a
+// not_primary error naming the primary if they know it. "ROLE" is answered
+// by every server with "ROLE <role> <epoch> <seq> [<primary>]".
+//
+// A server started with -auth answers only ROLE, PROTOCOL and
+//
+//	AUTH <token>
+//
+// until the client is authenticated, by that or by a TLS client
+// certificate, and refuses the operations the client's identity is not
+// allowed with an unauthenticated or forbidden error.
+//
+// A client over its rate limit, or any client while the server evaluates as
+// many commands as it may, gets a busy error saying when to retry, e.g.
+// "Error: busy, retry after 250ms". The command was not executed.
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"sd/Assignment1/calculator"
+)
+
+// Request is a command sent in the JSON protocol. Mode optionally selects the
+// numeric mode of this request only, e.g. "rat" or "decimal:2".
+type Request struct {
+	ID      uint64 `json:"id"`
+	Key     string `json:"key,omitempty"`
+	Command string `json:"command"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+// Response answers the Request with the same ID. Exactly one of Result, Text
+// and Error is set: Result for calculations, Text for other commands such as
+// history. Calculations in the exact numeric modes also carry the exact
+// Value as a string, Result is then only an approximation and left out when
+// it does not fit a float64.
+type Response struct {
+	ID     uint64         `json:"id"`
+	Result *float64       `json:"result,omitempty"`
+	Value  string         `json:"value,omitempty"`
+	Mode   string         `json:"mode,omitempty"`
+	Text   string         `json:"text,omitempty"`
+	Error  *ResponseError `json:"error,omitempty"`
+}
+
+// ResponseError describes a failed request by a code from the list below and
+// a human readable message
+type ResponseError struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // set with code busy
+}
+
+// Error codes of the JSON protocol, including those of the calculator
+const (
+	CodeInvalidRequest  = "invalid_request" // the line is not a valid JSON request
+	CodeInvalidFormat   = calculator.CodeInvalidFormat
+	CodeInvalidNumber   = calculator.CodeInvalidNumber
+	CodeSyntaxError     = calculator.CodeSyntaxError
+	CodeUnknownName     = calculator.CodeUnknownName
+	CodeInvalidName     = "invalid_name" // the name cannot be assigned with let
+	CodeDivisionByZero  = calculator.CodeDivisionByZero
+	CodeDomainError     = calculator.CodeDomainError
+	CodeInexact         = calculator.CodeInexact
+	CodeInvalidMode     = calculator.CodeInvalidMode
+	CodeUnknownSession  = "unknown_session"
+	CodeNotPrimary      = "not_primary"     // sent to a backup, retry with the primary
+	CodeUnauthenticated = "unauthenticated" // AUTH is needed first, or the token is invalid
+	CodeForbidden       = "forbidden"       // the client's identity may not use the operation
+	CodeBusy            = "busy"            // over the rate limit or overloaded, retry after RetryAfterMs
+)
+
+// NotPrimaryMessage starts the message of not_primary errors, in the text
+// protocol after "Error: "
+const NotPrimaryMessage = "not the primary"
+
+// NotPrimary reports whether a response line of either protocol is a
+// not_primary error, and returns the primary it names, if any
+func NotPrimary(line string) (primary string, ok bool) {
+	message, ok := strings.CutPrefix(line, "Error: ")
+	if !ok {
+		var resp Response
+		if json.Unmarshal([]byte(line), &resp) != nil || resp.Error == nil || resp.Error.Code != CodeNotPrimary {
+			return "", false
+		}
+		message = resp.Error.Message
+	}
+	rest, ok := strings.CutPrefix(message, NotPrimaryMessage)
+	if !ok {
+		return "", false
+	}
+	primary, _ = strings.CutPrefix(rest, ", the primary is ")
+	if primary == rest {
+		primary = ""
+	}
+	return primary, true
+}
+
+// BusyMessage starts the message of busy errors, in the text protocol after
+// "Error: ", and is followed by ", retry after <duration>"
+const BusyMessage = "busy"
+
+// Busy reports whether a response line of either protocol is a busy error,
+// and returns how long the server asked to wait before retrying
+func Busy(line string) (retryAfter time.Duration, ok bool) {
+	message, ok := strings.CutPrefix(line, "Error: ")
+	if !ok {
+		var resp Response
+		if json.Unmarshal([]byte(line), &resp) != nil || resp.Error == nil || resp.Error.Code != CodeBusy {
+			return 0, false
+		}
+		return time.Duration(resp.Error.RetryAfterMs) * time.Millisecond, true
+	}
+	after, ok := strings.CutPrefix(message, BusyMessage+", retry after ")
+	if !ok {
+		return 0, false
+	}
+	retryAfter, err := time.ParseDuration(after)
+	return retryAfter, err == nil
+}
+
+// CutRequestKey splits "REQUEST <key> <command>" into key and command, and
+// returns an empty key for lines without one
+func CutRequestKey(line string) (key, command string) {
+	rest, ok := strings.CutPrefix(line, "REQUEST ")
+	if !ok {
+		return "", line
+	}
+	key, command, _ = strings.Cut(strings.TrimLeft(rest, " "), " ")
+	return key, command
+}
+
+// Names of the protocols, as in "PROTOCOL <name>"
+const (
+	Text     = "text"
+	JSON     = "json"
+	Pipeline = "pipeline"
+)
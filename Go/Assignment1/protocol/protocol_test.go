@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotPrimary(t *testing.T) {
+	tests := []struct {
+		line    string
+		primary string
+		ok      bool
+	}{
+		{"Error: not the primary, the primary is localhost:8090", "localhost:8090", true},
+		{"Error: not the primary", "", true},
+		{`{"id":3,"error":{"code":"not_primary","message":"not the primary, the primary is localhost:8091"}}`, "localhost:8091", true},
+		{`{"id":3,"error":{"code":"busy","message":"busy, retry after 1s","retry_after_ms":1000}}`, "", false},
+		{"Error: division by zero", "", false},
+		{"5.000000", "", false},
+	}
+	for _, tt := range tests {
+		primary, ok := NotPrimary(tt.line)
+		if primary != tt.primary || ok != tt.ok {
+			t.Errorf("NotPrimary(%q) = %q, %v, want %q, %v", tt.line, primary, ok, tt.primary, tt.ok)
+		}
+	}
+}
+
+func TestBusy(t *testing.T) {
+	tests := []struct {
+		line       string
+		retryAfter time.Duration
+		ok         bool
+	}{
+		{"Error: busy, retry after 250ms", 250 * time.Millisecond, true},
+		{`{"id":1,"error":{"code":"busy","message":"busy, retry after 1s","retry_after_ms":1000}}`, time.Second, true},
+		{"Error: busy, retry after soon", 0, false},
+		{"Error: not the primary", 0, false},
+		{`{"id":1,"result":2}`, 0, false},
+	}
+	for _, tt := range tests {
+		retryAfter, ok := Busy(tt.line)
+		if retryAfter != tt.retryAfter || ok != tt.ok {
+			t.Errorf("Busy(%q) = %v, %v, want %v, %v", tt.line, retryAfter, ok, tt.retryAfter, tt.ok)
+		}
+	}
+}
+
+func TestCutRequestKey(t *testing.T) {
+	tests := []struct {
+		line, key, command string
+	}{
+		{"REQUEST k1 add 1 2", "k1", "add 1 2"},
+		{"REQUEST   k2 history", "k2", "history"},
+		{"add 1 2", "", "add 1 2"},
+	}
+	for _, tt := range tests {
+		key, command := CutRequestKey(tt.line)
+		if key != tt.key || command != tt.command {
+			t.Errorf("CutRequestKey(%q) = %q, %q, want %q, %q", tt.line, key, command, tt.key, tt.command)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	sl := NewServerList("a:1,b:2,c:3")
+	if got := sl.Failover("a:1", ""); got != "b:2" {
+		t.Errorf("Failover(a:1) = %s, want the next server b:2", got)
+	}
+	if got := sl.Failover("a:1", ""); got != "b:2" {
+		t.Errorf("Failover(a:1) again = %s, want b:2 unchanged", got)
+	}
+	if got := sl.Failover("b:2", "a:1"); got != "a:1" {
+		t.Errorf("Failover(b:2, a:1) = %s, want the hint a:1", got)
+	}
+	if got := sl.Primary(); got != "a:1" {
+		t.Errorf("Primary() = %s, want a:1", got)
+	}
+}
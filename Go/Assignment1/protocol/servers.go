@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ServerList is the calculator servers a client may talk to: a single server,
+// or the replicas of a replicated server of which only the primary answers
+type ServerList struct {
+	mu      sync.Mutex
+	addrs   []string
+	current int
+}
+
+// NewServerList parses a comma separated list of host:port
+func NewServerList(spec string) *ServerList {
+	return &ServerList{addrs: strings.Split(spec, ",")}
+}
+
+// All returns every server of the list
+func (sl *ServerList) All() []string {
+	return sl.addrs
+}
+
+// Primary returns the server believed to be the primary
+func (sl *ServerList) Primary() string {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.addrs[sl.current]
+}
+
+// Failover moves on from failed, which either could not be reached or is not
+// the primary, to hint if it named the primary and to the next server
+// otherwise. It returns the new primary, unchanged if another caller already
+// moved on from failed.
+func (sl *ServerList) Failover(failed, hint string) string {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.addrs[sl.current] != failed {
+		return sl.addrs[sl.current]
+	}
+	if i := slices.Index(sl.addrs, hint); i >= 0 {
+		sl.current = i
+	} else {
+		sl.current = (sl.current + 1) % len(sl.addrs)
+	}
+	return sl.addrs[sl.current]
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
-	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"sd/transport"
 )
 
 // Peer struct holds information about the peer's host, port, and neighbors
@@ -18,30 +24,44 @@ type Peer struct {
 	Port      int
 	Neighbors map[string]time.Time // [IP] -> timestamp
 	mu        sync.Mutex           // Protects access to Neighbors
+	sending   sync.WaitGroup       // disseminations in flight
+	quit      chan struct{}        // closed on shutdown, closes the listener
+	transport *transport.Transport
 }
 
 // NewPeer creates a new Peer with the given host and port
-func NewPeer(host string, port int) *Peer {
+func NewPeer(host string, port int, transport *transport.Transport) *Peer {
 	return &Peer{
 		Host:      host,
 		Port:      port,
 		Neighbors: make(map[string]time.Time),
+		quit:      make(chan struct{}),
+		transport: transport,
 	}
 }
 
 // StartServer starts the peer's server to listen for incoming connections
 func (p *Peer) StartServer() {
 	addr := fmt.Sprintf("%s:%d", p.Host, p.Port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := p.transport.Listen(addr)
 	if err != nil {
 		log.Fatalf("Failed to start server on %s: %v", addr, err)
 	}
 	defer listener.Close()
 	log.Printf("Peer server listening on %s...", addr)
+	go func() {
+		<-p.quit
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
@@ -90,8 +110,10 @@ func (p *Peer) disseminateNeighbors() {
 	p.mu.Unlock()
 
 	for ip := range p.Neighbors {
+		p.sending.Add(1)
 		go func(ip string) {
-			conn, err := net.Dial("tcp", ip)
+			defer p.sending.Done()
+			conn, err := p.transport.Dial(ip)
 			if err != nil {
 				log.Printf("Failed to connect to neighbor %s: %v", ip, err)
 				return
@@ -102,6 +124,12 @@ func (p *Peer) disseminateNeighbors() {
 	}
 }
 
+// Shutdown waits for the disseminations in flight and closes the listener
+func (p *Peer) Shutdown() {
+	p.sending.Wait()
+	close(p.quit)
+}
+
 // cleanupNeighbors removes stale neighbors based on a threshold
 func (p *Peer) cleanupNeighbors() {
 	threshold := 2 * time.Minute // Example: 2-minute threshold
@@ -152,12 +180,16 @@ func formatNeighborData(data string) string {
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: go run peer.go <host:port> [<host:port>...]")
+	var tlsFiles transport.TLSFiles
+	tlsFiles.AddFlags()
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		log.Fatalf("Usage: go run peer.go poisson.go [flags] <host:port> [<host:port>...]")
 	}
 
 	// Parse the first argument as the current peer's address
-	currentAddr := os.Args[1]
+	currentAddr := args[0]
 	parts := strings.Split(currentAddr, ":")
 	if len(parts) != 2 {
 		log.Fatalf("Invalid address format: %s", currentAddr)
@@ -166,10 +198,15 @@ func main() {
 	host := parts[0]
 	port := atoi(parts[1])
 
-	peer := NewPeer(host, port)
+	// Peers only accept each other with a certificate signed by the CA
+	transport, err := transport.New(tlsFiles, tls.RequireAndVerifyClientCert)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	peer := NewPeer(host, port, transport)
 
 	// Parse additional arguments as neighbor addresses
-	for _, addr := range os.Args[2:] {
+	for _, addr := range args[1:] {
 		peer.mu.Lock()
 		peer.Neighbors[addr] = time.Now()
 		peer.mu.Unlock()
@@ -180,8 +217,18 @@ func main() {
 
 	pp := NewPoissonProcess(0.0333, time.Now().UnixNano()) // Poisson process 2 times per minute
 
+	// SIGINT or SIGTERM stop the peer once its messages are out
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	for {
-		time.Sleep(time.Duration(pp.TimeForNextEvent()) * time.Second) // Wait based on Poisson interval
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down...")
+			peer.Shutdown()
+			log.Println("Peer stopped")
+			return
+		case <-time.After(time.Duration(pp.TimeForNextEvent()) * time.Second): // Wait based on Poisson interval
+		}
 		peer.disseminateNeighbors()
 		log.Printf("Disseminated neighbors. Current map size: %d", len(peer.Neighbors))
 	}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
     "math/rand"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"sd/transport"
 )
 
 // Message represents a network message
@@ -31,10 +38,14 @@ type Peer struct {
 	MessageQ   []Message
 	Processed  map[string]bool
 	ReadyPeers map[string]bool
+	sending    sync.WaitGroup // messages still being delivered to neighbors
+	giveUp     chan struct{}  // closed when a shutdown stops retrying deliveries
+	quit       chan struct{}  // closed on shutdown, closes the listener
+	transport  *transport.Transport
 }
 
 // NewPeer creates a new Peer
-func NewPeer(host string, port int, neighbors []string) *Peer {
+func NewPeer(host string, port int, neighbors []string, transport *transport.Transport) *Peer {
 	return &Peer{
 		Host:       host,
 		Port:       port,
@@ -42,6 +53,9 @@ func NewPeer(host string, port int, neighbors []string) *Peer {
 		MessageQ:   make([]Message, 0),
 		Processed:  make(map[string]bool),
 		ReadyPeers: make(map[string]bool),
+		giveUp:     make(chan struct{}),
+		quit:       make(chan struct{}),
+		transport:  transport,
 	}
 }
 
@@ -80,16 +94,25 @@ func parseNeighbors(neighbors []string) []string {
 // StartServer starts the peer's server to accept incoming connections
 func (p *Peer) StartServer() {
 	addr := fmt.Sprintf("%s:%d", p.Host, p.Port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := p.transport.Listen(addr)
 	if err != nil {
 		log.Fatalf("Failed to start server on %s: %v", addr, err)
 	}
 	defer listener.Close()
 	log.Printf("[INFO] Peer listening on %s", addr)
+	go func() {
+		<-p.quit
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
 			log.Printf("[ERROR] Accepting connection: %v", err)
 			continue
 		}
@@ -169,7 +192,7 @@ func (p *Peer) notifyReady() {
 	for _, neighbor := range p.Neighbors {
 		go func(neighbor string) {
 			for {
-				conn, err := net.Dial("tcp", neighbor)
+				conn, err := p.transport.Dial(neighbor)
 				if err != nil {
 					log.Printf("[RETRY] Ready notification to %s failed: %v", neighbor, err)
 					time.Sleep(1 * time.Second)
@@ -184,8 +207,8 @@ func (p *Peer) notifyReady() {
 	}
 }
 
-// waitForNeighborsReady waits for all neighbors to send "ready"
-func (p *Peer) waitForNeighborsReady() {
+// waitForNeighborsReady waits for all neighbors to send "ready", or until ctx is done
+func (p *Peer) waitForNeighborsReady(ctx context.Context) {
 	log.Println("[INFO] Waiting for neighbors to be ready...")
 	for {
 		p.mu.Lock()
@@ -195,7 +218,11 @@ func (p *Peer) waitForNeighborsReady() {
 			log.Println("[INFO] All neighbors are ready.")
 			return
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
@@ -209,12 +236,19 @@ func (p *Peer) disseminateMessage() {
 	content := randomWord()
 
 	for _, neighbor := range p.Neighbors {
+		p.sending.Add(1)
 		go func(neighbor string) {
+			defer p.sending.Done()
 			for {
-				conn, err := net.Dial("tcp", neighbor)
+				conn, err := p.transport.Dial(neighbor)
 				if err != nil {
 					log.Printf("[RETRY] Connection to neighbor %s failed: %v", neighbor, err)
-					time.Sleep(2 * time.Second)
+					select {
+					case <-p.giveUp:
+						log.Printf("[ERROR] Message to %s dropped on shutdown", neighbor)
+						return
+					case <-time.After(2 * time.Second):
+					}
 					continue
 				}
 				defer conn.Close()
@@ -228,13 +262,45 @@ func (p *Peer) disseminateMessage() {
 	}
 }
 
+// shutdownTimeout bounds how long a shutdown keeps retrying deliveries
+const shutdownTimeout = 10 * time.Second
+
+// Shutdown finishes delivering the messages sent so far, shows the messages
+// still waiting in the queue and closes the listener
+func (p *Peer) Shutdown() {
+	done := make(chan struct{})
+	go func() {
+		p.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		close(p.giveUp)
+		<-done
+	}
+
+	// Messages waiting for earlier timestamps will not see them anymore
+	p.mu.Lock()
+	for _, msg := range p.MessageQ {
+		fmt.Printf("[CHAT] %s: %s (flushed)\n", time.Now().Format("15:04:05"), msg.Content)
+	}
+	p.MessageQ = nil
+	p.mu.Unlock()
+	close(p.quit)
+}
+
 // Main function
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("[ERROR] Usage: %s <host:port> <neighbor1> [neighbor2] ...", os.Args[0])
+	var tlsFiles transport.TLSFiles
+	tlsFiles.AddFlags()
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		log.Fatalf("[ERROR] Usage: %s [flags] <host:port> <neighbor1> [neighbor2] ...", os.Args[0])
 	}
 
-	hostPort := os.Args[1]
+	hostPort := args[0]
 	hostPortParts := strings.Split(hostPort, ":")
 	if len(hostPortParts) != 2 {
 		log.Fatalf("[ERROR] Invalid host:port format: %s", hostPort)
@@ -246,19 +312,36 @@ func main() {
 		log.Fatalf("[ERROR] Invalid port number in host:port: %s", hostPortParts[1])
 	}
 
-	neighbors := parseNeighbors(os.Args[2:])
+	neighbors := parseNeighbors(args[1:])
 	log.Printf("[INFO] Starting peer on %s:%d with neighbors: %v", host, port, neighbors)
 
-	peer := NewPeer(host, port, neighbors)
+	// Peers only accept each other with a certificate signed by the CA
+	transport, err := transport.New(tlsFiles, tls.RequireAndVerifyClientCert)
+	if err != nil {
+		log.Fatalf("[ERROR] Loading TLS certificates: %v", err)
+	}
+	peer := NewPeer(host, port, neighbors, transport)
 	go peer.StartServer()
 
+	// SIGINT or SIGTERM stop the peer once its messages are out
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	peer.notifyReady()
-	peer.waitForNeighborsReady()
+	peer.waitForNeighborsReady(ctx)
 
 	pp := NewPoissonProcess(1.0, time.Now().UnixNano()) // 1 message per second
-	for {
+	for ctx.Err() == nil {
 		interval := pp.TimeForNextEvent()
-		time.Sleep(time.Duration(interval * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			continue
+		case <-time.After(time.Duration(interval * float64(time.Second))):
+		}
 		peer.disseminateMessage()
 	}
+
+	log.Println("[INFO] Shutting down...")
+	peer.Shutdown()
+	log.Println("[INFO] Peer stopped")
 }
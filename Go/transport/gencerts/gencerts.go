@@ -0,0 +1,32 @@
+// Gencerts writes a self-signed test CA and certificates signed by it, for
+// running the programs with TLS on one host:
+//
+//	go run ./transport/gencerts -dir certs server client peer
+//
+// then e.g. -tls-cert certs/peer.pem -tls-key certs/peer.key -tls-ca certs/ca.pem.
+// Running it again with other names adds their certificates, signed by the
+// same CA.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"sd/transport"
+)
+
+func main() {
+	dir := flag.String("dir", "certs", "directory the certificates are written to")
+	flag.Parse()
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"server", "client", "peer"}
+	}
+	if err := transport.GenerateCerts(*dir, names); err != nil {
+		fmt.Println("Error generating certificates:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote certificates for %s signed by %s\n", strings.Join(names, ", "), *dir+"/ca.pem")
+}
@@ -0,0 +1,241 @@
+// Package transport opens the TCP connections of every program of the
+// assignments. Without certificates it is plain TCP. Given -tls-cert and
+// -tls-key a program listens with TLS, and given -tls-ca it verifies the
+// other side's certificates with that CA: the servers it dials, and the
+// clients it accepts if it asks for their certificates, which peers require
+// of each other. Certificates for testing are made by the gencerts command.
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSFiles names the PEM files a program secures its connections with
+type TLSFiles struct {
+	TLS  bool   // TLS even without files, verifying servers with the system's CAs
+	Cert string // certificate presented to the other side
+	Key  string // private key of Cert
+	CA   string // CA verifying the other side's certificates
+}
+
+// AddFlags registers -tls, -tls-cert, -tls-key and -tls-ca for the files
+func (f *TLSFiles) AddFlags() {
+	flag.BoolVar(&f.TLS, "tls", f.TLS, "use TLS, implied by the other -tls flags")
+	flag.StringVar(&f.Cert, "tls-cert", f.Cert, "certificate file presented to the other side")
+	flag.StringVar(&f.Key, "tls-key", f.Key, "private key file of -tls-cert")
+	flag.StringVar(&f.CA, "tls-ca", f.CA, "CA file verifying the other side's certificates, by default the system's")
+}
+
+// Enabled reports whether connections use TLS
+func (f TLSFiles) Enabled() bool {
+	return f.TLS || f.Cert != "" || f.CA != ""
+}
+
+// Transport opens the TCP connections of a program
+type Transport struct {
+	server *tls.Config // nil for plain TCP, or without a certificate
+	client *tls.Config // nil for plain TCP
+}
+
+// New loads the TLS files, if any. clientAuth is what listeners ask
+// of clients when a CA is given, e.g. tls.RequireAndVerifyClientCert between
+// peers.
+func New(files TLSFiles, clientAuth tls.ClientAuthType) (*Transport, error) {
+	t := &Transport{}
+	if !files.Enabled() {
+		return t, nil
+	}
+	t.client = &tls.Config{MinVersion: tls.VersionTLS12}
+	if files.CA != "" {
+		pool, err := loadCertPool(files.CA)
+		if err != nil {
+			return nil, err
+		}
+		t.client.RootCAs = pool
+	}
+	if files.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return nil, err
+		}
+		t.client.Certificates = []tls.Certificate{cert}
+		t.server = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if files.CA != "" {
+			t.server.ClientCAs = t.client.RootCAs
+			t.server.ClientAuth = clientAuth
+		}
+	}
+	return t, nil
+}
+
+// Secure reports whether the transport uses TLS
+func (t *Transport) Secure() bool {
+	return t.client != nil
+}
+
+// Listen listens on addr, in TLS if the transport has a certificate
+func (t *Transport) Listen(addr string) (net.Listener, error) {
+	if t.client != nil && t.server == nil {
+		return nil, errors.New("listening with TLS needs a certificate")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || t.server == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, t.server), nil
+}
+
+// Dial connects to addr
+func (t *Transport) Dial(addr string) (net.Conn, error) {
+	return t.DialTimeout(addr, 0)
+}
+
+// DialTimeout connects to addr, giving up after timeout, 0 for none
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if t.client == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, t.client)
+}
+
+// loadCertPool reads the PEM certificates in path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// PeerCommonName returns the common name of the verified certificate a TLS
+// client presented, or an empty string
+func PeerCommonName(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// certValidity is how long generated certificates are valid
+const certValidity = 365 * 24 * time.Hour
+
+// GenerateCerts writes a certificate <name>.pem with key <name>.key into dir
+// for each name, with the name as common name, valid for localhost and
+// usable by servers and clients alike. They are signed by the CA in
+// ca.pem and ca.key, which is created unless dir already has one.
+func GenerateCerts(dir string, names []string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	caCert, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serialNumber(),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(certValidity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		if name != "localhost" && net.ParseIP(name) == nil {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writeKeyPair(filepath.Join(dir, name), der, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCA writes a new self-signed CA into dir
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeKeyPair(filepath.Join(dir, "ca"), der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// loadCA reads the CA written by createCA
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("the CA key is not an ECDSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	return cert, key, err
+}
+
+// writeKeyPair writes the certificate to base.pem and its key to base.key
+func writeKeyPair(base string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+// serialNumber returns a random certificate serial number
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}